@@ -0,0 +1,160 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"hash/fnv"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Balancer pick a pipeline for a call.
+type Balancer interface {
+	// Pick a pipeline.
+	// @param ctx, the context of the call.
+	// @param pipelines, the available pipelines of a peer type, sorted by peer No., not empty.
+	// @return *Pipeline, the chosen one.
+	Pick(ctx context.Context, pipelines []*Pipeline) *Pipeline
+}
+
+//========================
+//      round robin
+//========================
+type RoundRobinBalancer struct {
+	next uint32
+	lck  *sync.Mutex
+}
+
+func NewRoundRobinBalancer() *RoundRobinBalancer {
+	return &RoundRobinBalancer{
+		next: 0,
+		lck:  &sync.Mutex{},
+	}
+}
+
+func (b *RoundRobinBalancer) Pick(ctx context.Context, pipelines []*Pipeline) *Pipeline {
+	b.lck.Lock()
+	defer b.lck.Unlock()
+
+	idx := b.next % uint32(len(pipelines))
+	b.next++
+	return pipelines[idx]
+}
+
+//========================
+//     least pending
+//========================
+// Pick the pipeline with the least in-flight requests, the first one if equal.
+type LeastPendingBalancer struct {
+}
+
+func NewLeastPendingBalancer() *LeastPendingBalancer {
+	return &LeastPendingBalancer{}
+}
+
+func (b *LeastPendingBalancer) Pick(ctx context.Context, pipelines []*Pipeline) *Pipeline {
+	chosen := pipelines[0]
+	minPending := chosen.GetPendingCount()
+	for _, p := range pipelines[1:] {
+		pending := p.GetPendingCount()
+		if pending < minPending {
+			chosen = p
+			minPending = pending
+		}
+	}
+
+	return chosen
+}
+
+//========================
+//        random
+//========================
+type RandomBalancer struct {
+	rnd *rand.Rand
+	lck *sync.Mutex
+}
+
+func NewRandomBalancer() *RandomBalancer {
+	return &RandomBalancer{
+		rnd: rand.New(rand.NewSource(time.Now().UnixNano())),
+		lck: &sync.Mutex{},
+	}
+}
+
+func (b *RandomBalancer) Pick(ctx context.Context, pipelines []*Pipeline) *Pipeline {
+	b.lck.Lock()
+	defer b.lck.Unlock()
+
+	return pipelines[b.rnd.Intn(len(pipelines))]
+}
+
+//========================
+//    consistent hash
+//========================
+// Pick by the key set by NewBalanceKeyContext, the same key go to the same peer
+// while it is available, and only the keys of a removed peer move.
+// It use rendezvous hashing, the calls without key are picked randomly.
+type ConsistentHashBalancer struct {
+	fallback *RandomBalancer
+}
+
+func NewConsistentHashBalancer() *ConsistentHashBalancer {
+	return &ConsistentHashBalancer{
+		fallback: NewRandomBalancer(),
+	}
+}
+
+func (b *ConsistentHashBalancer) Pick(ctx context.Context, pipelines []*Pipeline) *Pipeline {
+	key, ok := FromBalanceKeyContext(ctx)
+	if !ok {
+		return b.fallback.Pick(ctx, pipelines)
+	}
+
+	var chosen *Pipeline = nil
+	maxWeight := uint64(0)
+	for _, p := range pipelines {
+		weight := rendezvousWeight(key, GetPeerId(p.GetPeerType(), p.GetPeerNo()))
+		if chosen == nil || weight > maxWeight {
+			chosen = p
+			maxWeight = weight
+		}
+	}
+
+	return chosen
+}
+
+func rendezvousWeight(key string, peerId uint32) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h.Write([]byte{byte(peerId >> 24), byte(peerId >> 16), byte(peerId >> 8), byte(peerId)})
+	return mixHash(h.Sum64())
+}
+
+// spread the bits, fnv alone changes few high bits for the last bytes.
+func mixHash(x uint64) uint64 {
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+//========================
+//       context
+//========================
+type balanceKey struct{}
+
+// Set the key for ConsistentHashBalancer.
+func NewBalanceKeyContext(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, balanceKey{}, key)
+}
+
+func FromBalanceKeyContext(ctx context.Context) (string, bool) {
+	key, ok := ctx.Value(balanceKey{}).(string)
+	return key, ok
+}
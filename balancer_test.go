@@ -0,0 +1,170 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// create the pipelines of peer No. 1 to n, not started.
+func newTestBalancePipelines(n uint32) []*Pipeline {
+	pipelines := make([]*Pipeline, 0, n)
+	for peerNo := uint32(1); peerNo <= n; peerNo++ {
+		a, _ := NewLoopbackNetPair(TEST_CLIENT_PEER_TYPE, TEST_CLIENT_PEER_NO, TEST_SERVER_PEER_TYPE, peerNo, TEST_MAX_READ_QUE)
+		pipelines = append(pipelines, NewPipeline(a, TEST_SERVER_PEER_TYPE, peerNo, TEST_MARK))
+	}
+
+	return pipelines
+}
+
+func TestRoundRobinBalancer(t *testing.T) {
+	pipelines := newTestBalancePipelines(3)
+	b := NewRoundRobinBalancer()
+	for i := 0; i < 7; i++ {
+		p := b.Pick(context.Background(), pipelines)
+		if p != pipelines[i%3] {
+			t.Fatalf("pick %d: peer %d, want %d", i, p.GetPeerNo(), pipelines[i%3].GetPeerNo())
+		}
+	}
+}
+
+func TestLeastPendingBalancer(t *testing.T) {
+	pipelines := newTestBalancePipelines(3)
+	b := NewLeastPendingBalancer()
+
+	// the first one if equal
+	if b.Pick(context.Background(), pipelines) != pipelines[0] {
+		t.Fatal("not the first one")
+	}
+
+	pipelines[0].mapSno2Req[1] = NewRequest(NewPackHeader(TEST_MARK, 1, 1))
+	pipelines[0].mapSno2Req[2] = NewRequest(NewPackHeader(TEST_MARK, 2, 1))
+	pipelines[1].mapSno2Stream[1] = nil
+	pipelines[1].mapSno2Stream[2] = nil
+	pipelines[2].mapSno2Req[1] = NewRequest(NewPackHeader(TEST_MARK, 1, 1))
+	if b.Pick(context.Background(), pipelines) != pipelines[2] {
+		t.Fatal("not the least pending one")
+	}
+}
+
+func TestRandomBalancer(t *testing.T) {
+	pipelines := newTestBalancePipelines(3)
+	b := NewRandomBalancer()
+	mapPicked := make(map[*Pipeline]int)
+	for i := 0; i < 300; i++ {
+		mapPicked[b.Pick(context.Background(), pipelines)]++
+	}
+
+	for _, p := range pipelines {
+		if mapPicked[p] == 0 {
+			t.Fatalf("peer %d never picked", p.GetPeerNo())
+		}
+	}
+}
+
+func TestConsistentHashBalancer(t *testing.T) {
+	pipelines := newTestBalancePipelines(4)
+	b := NewConsistentHashBalancer()
+
+	mapKey2Pipeline := make(map[string]*Pipeline)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprint("user", i)
+		ctx := NewBalanceKeyContext(context.Background(), key)
+		p := b.Pick(ctx, pipelines)
+		if b.Pick(ctx, pipelines) != p {
+			t.Fatalf("key %s moved", key)
+		}
+
+		mapKey2Pipeline[key] = p
+	}
+
+	// only the keys of the removed peer move
+	removed := pipelines[1]
+	left := append([]*Pipeline{pipelines[0]}, pipelines[2:]...)
+	moved := 0
+	for key, old := range mapKey2Pipeline {
+		p := b.Pick(NewBalanceKeyContext(context.Background(), key), left)
+		if old != removed && p != old {
+			t.Fatalf("key %s moved from peer %d to %d", key, old.GetPeerNo(), p.GetPeerNo())
+		}
+
+		if old == removed {
+			moved++
+		}
+	}
+
+	if moved == 0 || moved == len(mapKey2Pipeline) {
+		t.Fatalf("%d of %d keys on the removed peer", moved, len(mapKey2Pipeline))
+	}
+
+	// no key, picked randomly
+	if b.Pick(context.Background(), pipelines) == nil {
+		t.Fatal("no pipeline picked")
+	}
+}
+
+func TestClientPickSkip(t *testing.T) {
+	const peerType = uint32(40)
+	services := make([]*testEchoService, 0, 3)
+	pipelines := make([]*Pipeline, 0, 3)
+	for peerNo := uint32(1); peerNo <= 3; peerNo++ {
+		svc := &testEchoService{no: peerNo}
+		services = append(services, svc)
+		pipelines = append(pipelines, addTestClientPipeline(t, peerType, peerNo, svc))
+	}
+
+	Client.SetBalancer(peerType, NewRoundRobinBalancer())
+
+	// the unhealthy one is skipped
+	pipelines[1].SetHealthy(false)
+	for i := 0; i < 4; i++ {
+		p, err := Client.PickPipeline(context.Background(), peerType)
+		if err != nil || p == pipelines[1] {
+			t.Fatalf("pick %d: %v", i, err)
+		}
+	}
+
+	// the open breaker is skipped
+	cfg := NewBreakerConfig()
+	cfg.MinRequests = 1
+	cfg.FailureRate = 1
+	cfg.OpenDuration = time.Minute
+	err := pipelines[2].SetCircuitBreaker(cfg, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	services[2].setFail(true)
+	_, err = pipelines[2].Call("Echo", "Say", &testReq{Msg: "x"}, &testResp{})
+	if GetErrorCode(err) != RES_CODE_UNAVAILABLE || pipelines[2].GetCircuitBreaker().GetState() != BREAKER_STATE_OPEN {
+		t.Fatalf("breaker not open: %v", err)
+	}
+
+	for i := 0; i < 4; i++ {
+		resp := &testResp{}
+		_, err = Client.CallType(peerType, "Echo", "Say", &testReq{Msg: "x"}, resp)
+		if err != nil || resp.Msg != "1:x" {
+			t.Fatalf("call %d: %q %v", i, resp.Msg, err)
+		}
+	}
+
+	// none available
+	pipelines[0].SetHealthy(false)
+	_, err = Client.PickPipeline(context.Background(), peerType)
+	if !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("err %v, want %v", err, ErrCircuitOpen)
+	}
+
+	pipelines[2].SetCircuitBreaker(nil, false)
+	pipelines[2].SetHealthy(false)
+	_, err = Client.PickPipeline(context.Background(), peerType)
+	if !errors.Is(err, ErrClientNoPipeline) {
+		t.Fatalf("err %v, want %v", err, ErrClientNoPipeline)
+	}
+}
@@ -0,0 +1,473 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	ErrCircuitOpen       = errors.New("circuit breaker is open")
+	ErrBreakerConfigNil  = errors.New("breaker config is nil")
+	ErrBreakerRateBadVal = errors.New("breaker rate out of (0, 1]")
+)
+
+// the min window of a breaker, the calls are hardly counted in a shorter one
+const RPC_BREAKER_MIN_WINDOW = 100 * time.Millisecond
+
+// breaker states
+const (
+	BREAKER_STATE_CLOSED uint8 = iota
+	// fail fast with ErrCircuitOpen
+	BREAKER_STATE_OPEN
+	// let a few probe calls through, close if they all succeed
+	BREAKER_STATE_HALF_OPEN
+)
+
+// Called when the state of a breaker change.
+// @param cb, the breaker.
+// @param from, the old state.
+// @param to, the new state.
+type BreakerStateFunc func(cb *CircuitBreaker, from uint8, to uint8)
+
+//========================
+//     BreakerConfig
+//========================
+type BreakerConfig struct {
+	// the length of the window to count the calls
+	Window time.Duration
+	// the min calls in a window to trip the breaker
+	MinRequests uint32
+	// trip when the failure rate reach it, in (0, 1]
+	FailureRate float64
+	// the calls not shorter than it are slow, 0 to disable
+	SlowCallDuration time.Duration
+	// trip when the slow call rate reach it, in (0, 1]
+	SlowCallRate float64
+	// the time to stay open before half-open
+	OpenDuration time.Duration
+	// the probe calls in half-open
+	HalfOpenProbes uint32
+	// the callback of state changes, may be nil
+	OnStateChange BreakerStateFunc
+}
+
+// Create a config trip at 50% failures of at least 20 calls in 10s,
+// open for 5s, then probe with 3 calls. The slow calls are not counted.
+func NewBreakerConfig() *BreakerConfig {
+	return &BreakerConfig{
+		Window:           10 * time.Second,
+		MinRequests:      20,
+		FailureRate:      0.5,
+		SlowCallDuration: 0,
+		SlowCallRate:     1,
+		OpenDuration:     5 * time.Second,
+		HalfOpenProbes:   3,
+		OnStateChange:    nil,
+	}
+}
+
+// copy the config, raise the 0 values to their min.
+// @return *BreakerConfig, the checked copy.
+// @return error, ErrBreakerRateBadVal if a rate is out of (0, 1].
+func (cfg *BreakerConfig) check() (*BreakerConfig, error) {
+	if cfg.FailureRate <= 0 || cfg.FailureRate > 1 || cfg.SlowCallRate <= 0 || cfg.SlowCallRate > 1 {
+		return nil, ErrBreakerRateBadVal
+	}
+
+	checked := *cfg
+	if checked.Window < RPC_BREAKER_MIN_WINDOW {
+		checked.Window = RPC_BREAKER_MIN_WINDOW
+	}
+
+	if checked.MinRequests == 0 {
+		checked.MinRequests = 1
+	}
+
+	if checked.OpenDuration < 0 {
+		checked.OpenDuration = 0
+	}
+
+	// a half-open breaker close after the probes succeed
+	if checked.HalfOpenProbes == 0 {
+		checked.HalfOpenProbes = 1
+	}
+
+	return &checked, nil
+}
+
+//========================
+//     CircuitBreaker
+//========================
+// CircuitBreaker fail fast the calls to a degraded peer.
+// The failures are the calls with RES_CODE_TIMEOUT, RES_CODE_UNAVAILABLE,
+// RES_CODE_SYS_ERR or RES_CODE_RESOURCE_EXHAUSTED, the canceled ones and the ones
+// never sent (IsNotSent) are not counted.
+type CircuitBreaker struct {
+	name  string
+	cfg   *BreakerConfig
+	state uint8
+	// increase on each state change, the results of the older ones are dropped
+	generation uint64
+
+	windowStart time.Time
+	total       uint32
+	failures    uint32
+	slowCalls   uint32
+
+	openTime      time.Time
+	probesRunning uint32
+	probesSucceed uint32
+
+	lck *sync.Mutex
+}
+
+// Create a breaker, the config is copied.
+// @param name, the name.
+// @param cfg, the config, Window not less than RPC_BREAKER_MIN_WINDOW,
+//         MinRequests and HalfOpenProbes not less than 1.
+// @return *CircuitBreaker, the breaker.
+// @return error, ErrBreakerConfigNil or ErrBreakerRateBadVal.
+func NewCircuitBreaker(name string, cfg *BreakerConfig) (*CircuitBreaker, error) {
+	if cfg == nil {
+		return nil, ErrBreakerConfigNil
+	}
+
+	checked, err := cfg.check()
+	if err != nil {
+		return nil, err
+	}
+
+	return newCircuitBreaker(name, checked), nil
+}
+
+func newCircuitBreaker(name string, cfg *BreakerConfig) *CircuitBreaker {
+	return &CircuitBreaker{
+		name:       name,
+		cfg:        cfg,
+		state:      BREAKER_STATE_CLOSED,
+		generation: 0,
+
+		windowStart: time.Now(),
+		total:       0,
+		failures:    0,
+		slowCalls:   0,
+
+		openTime:      time.Time{},
+		probesRunning: 0,
+		probesSucceed: 0,
+
+		lck: &sync.Mutex{},
+	}
+}
+
+func (cb *CircuitBreaker) GetName() string {
+	return cb.name
+}
+
+func (cb *CircuitBreaker) GetState() uint8 {
+	cb.lck.Lock()
+	defer cb.lck.Unlock()
+
+	return cb.state
+}
+
+// Check if a call can pass now, an open breaker can pass after OpenDuration as a probe.
+func (cb *CircuitBreaker) IsAvailable() bool {
+	cb.lck.Lock()
+	defer cb.lck.Unlock()
+
+	switch cb.state {
+	case BREAKER_STATE_OPEN:
+		return time.Since(cb.openTime) >= cb.cfg.OpenDuration
+
+	case BREAKER_STATE_HALF_OPEN:
+		return cb.probesRunning+cb.probesSucceed < cb.cfg.HalfOpenProbes
+
+	default:
+		return true
+	}
+}
+
+// allow a call.
+// @return uint64, the generation to record the result.
+// @return error, ErrCircuitOpen if not allowed.
+func (cb *CircuitBreaker) allow() (uint64, error) {
+	cb.lck.Lock()
+
+	var from, to uint8
+	changed := false
+	if cb.state == BREAKER_STATE_OPEN {
+		if time.Since(cb.openTime) < cb.cfg.OpenDuration {
+			cb.lck.Unlock()
+			return 0, ErrCircuitOpen
+		}
+
+		from, to, changed = cb.setState(BREAKER_STATE_HALF_OPEN)
+	}
+
+	if cb.state == BREAKER_STATE_HALF_OPEN {
+		if cb.probesRunning+cb.probesSucceed >= cb.cfg.HalfOpenProbes {
+			cb.lck.Unlock()
+			cb.notify(from, to, changed)
+			return 0, ErrCircuitOpen
+		}
+
+		cb.probesRunning++
+	}
+
+	generation := cb.generation
+	cb.lck.Unlock()
+
+	cb.notify(from, to, changed)
+	return generation, nil
+}
+
+// give back an allowed call not made.
+func (cb *CircuitBreaker) release(generation uint64) {
+	cb.lck.Lock()
+	defer cb.lck.Unlock()
+
+	if generation == cb.generation && cb.state == BREAKER_STATE_HALF_OPEN {
+		cb.probesRunning--
+	}
+}
+
+// record the result of an allowed call.
+func (cb *CircuitBreaker) record(generation uint64, code int32, err error, latency time.Duration) {
+	// the peer never saw the canceled or not sent calls
+	bSkipped := err != nil && (errors.Is(err, context.Canceled) || IsNotSent(err))
+	bFailure := err != nil && isBreakerFailure(code)
+	bSlow := cb.cfg.SlowCallDuration > 0 && latency >= cb.cfg.SlowCallDuration
+
+	cb.lck.Lock()
+	if generation != cb.generation {
+		cb.lck.Unlock()
+		return
+	}
+
+	var from, to uint8
+	changed := false
+	switch cb.state {
+	case BREAKER_STATE_CLOSED:
+		if bSkipped {
+			break
+		}
+
+		now := time.Now()
+		if now.Sub(cb.windowStart) >= cb.cfg.Window {
+			cb.resetWindow(now)
+		}
+
+		cb.total++
+		if bFailure {
+			cb.failures++
+		}
+
+		if bSlow {
+			cb.slowCalls++
+		}
+
+		if cb.shouldTrip() {
+			from, to, changed = cb.setState(BREAKER_STATE_OPEN)
+		}
+
+	case BREAKER_STATE_HALF_OPEN:
+		cb.probesRunning--
+		if bSkipped {
+			break
+		}
+
+		if bFailure || bSlow {
+			from, to, changed = cb.setState(BREAKER_STATE_OPEN)
+			break
+		}
+
+		cb.probesSucceed++
+		if cb.probesSucceed >= cb.cfg.HalfOpenProbes {
+			from, to, changed = cb.setState(BREAKER_STATE_CLOSED)
+		}
+	}
+
+	cb.lck.Unlock()
+	cb.notify(from, to, changed)
+}
+
+func (cb *CircuitBreaker) shouldTrip() bool {
+	if cb.total < cb.cfg.MinRequests || cb.total == 0 {
+		return false
+	}
+
+	total := float64(cb.total)
+	if float64(cb.failures)/total >= cb.cfg.FailureRate {
+		return true
+	}
+
+	return cb.cfg.SlowCallDuration > 0 && float64(cb.slowCalls)/total >= cb.cfg.SlowCallRate
+}
+
+// change the state with the lock held, notify after unlock.
+func (cb *CircuitBreaker) setState(state uint8) (uint8, uint8, bool) {
+	from := cb.state
+	if from == state {
+		return from, state, false
+	}
+
+	cb.state = state
+	cb.generation++
+	cb.probesRunning = 0
+	cb.probesSucceed = 0
+
+	now := time.Now()
+	switch state {
+	case BREAKER_STATE_OPEN:
+		cb.openTime = now
+
+	case BREAKER_STATE_CLOSED:
+		cb.resetWindow(now)
+	}
+
+	return from, state, true
+}
+
+func (cb *CircuitBreaker) resetWindow(now time.Time) {
+	cb.windowStart = now
+	cb.total = 0
+	cb.failures = 0
+	cb.slowCalls = 0
+}
+
+func (cb *CircuitBreaker) notify(from uint8, to uint8, changed bool) {
+	if changed && cb.cfg.OnStateChange != nil {
+		cb.cfg.OnStateChange(cb, from, to)
+	}
+}
+
+func isBreakerFailure(code int32) bool {
+	return code == RES_CODE_TIMEOUT || code == RES_CODE_UNAVAILABLE ||
+		code == RES_CODE_SYS_ERR || code == RES_CODE_RESOURCE_EXHAUSTED
+}
+
+//========================
+//     pipeline
+//========================
+// Enable the circuit breaker of the pipeline, set it before Start.
+// The breakers are named "peerType-peerNo" and "peerType-peerNo/service.func".
+// @param cfg, the config, nil to disable. It is copied and checked as NewCircuitBreaker.
+// Only Call, CallContext and AsyncCall pass the breakers, CallByFuncName,
+// CallNoReturn and the streams are neither refused nor counted by them.
+// @param bPerFunc, true to add a breaker for each service.func too.
+// @return error, ErrBreakerRateBadVal if a rate is out of (0, 1].
+func (p *Pipeline) SetCircuitBreaker(cfg *BreakerConfig, bPerFunc bool) error {
+	var checked *BreakerConfig = nil
+	if cfg != nil {
+		var err error
+		checked, err = cfg.check()
+		if err != nil {
+			return p.ec.Throw("SetCircuitBreaker", err)
+		}
+	}
+
+	p.lckBreakers.Lock()
+	defer p.lckBreakers.Unlock()
+
+	p.breakerCfg = checked
+	p.bFuncBreaker = bPerFunc
+	p.breaker = nil
+	p.mapFuncName2Breaker = make(map[string]*CircuitBreaker)
+	if checked != nil {
+		p.breaker = newCircuitBreaker(fmt.Sprintf("%d-%d", p.peerType, p.peerNo), checked)
+	}
+
+	return nil
+}
+
+// Get the breaker of the pipeline, nil if not enabled.
+func (p *Pipeline) GetCircuitBreaker() *CircuitBreaker {
+	p.lckBreakers.Lock()
+	defer p.lckBreakers.Unlock()
+
+	return p.breaker
+}
+
+// Get the breaker of a service.func, nil if not enabled.
+func (p *Pipeline) GetFuncCircuitBreaker(serviceName string, funcName string) *CircuitBreaker {
+	p.lckBreakers.Lock()
+	defer p.lckBreakers.Unlock()
+
+	return p.mapFuncName2Breaker[GetFullFuncName(serviceName, funcName)]
+}
+
+// check if the breakers let the calls of the func pass, fullFuncName is "" for the pipeline one only.
+func (p *Pipeline) isBreakerAvailable(fullFuncName string) bool {
+	p.lckBreakers.Lock()
+	breaker := p.breaker
+	funcBreaker := p.mapFuncName2Breaker[fullFuncName]
+	p.lckBreakers.Unlock()
+
+	if breaker != nil && !breaker.IsAvailable() {
+		return false
+	}
+
+	return funcBreaker == nil || funcBreaker.IsAvailable()
+}
+
+// get the breakers of the func, the func one first.
+func (p *Pipeline) getBreakers(serviceName string, funcName string) []*CircuitBreaker {
+	p.lckBreakers.Lock()
+	defer p.lckBreakers.Unlock()
+
+	if p.breaker == nil {
+		return nil
+	}
+
+	breakers := make([]*CircuitBreaker, 0, 2)
+	if p.bFuncBreaker {
+		fullFuncName := GetFullFuncName(serviceName, funcName)
+		funcBreaker, ok := p.mapFuncName2Breaker[fullFuncName]
+		if !ok {
+			funcBreaker = newCircuitBreaker(p.breaker.GetName()+"/"+fullFuncName, p.breakerCfg)
+			p.mapFuncName2Breaker[fullFuncName] = funcBreaker
+		}
+
+		breakers = append(breakers, funcBreaker)
+	}
+
+	return append(breakers, p.breaker)
+}
+
+func (p *Pipeline) callWithBreaker(ctx context.Context, serviceName string, funcName string, reqObj interface{}, respObj interface{}) (int32, error) {
+	breakers := p.getBreakers(serviceName, funcName)
+	if len(breakers) == 0 {
+		return p.callImpl(ctx, serviceName, funcName, reqObj, respObj)
+	}
+
+	generations := make([]uint64, 0, len(breakers))
+	for i, breaker := range breakers {
+		generation, err := breaker.allow()
+		if err != nil {
+			for j := 0; j < i; j++ {
+				breakers[j].release(generations[j])
+			}
+
+			return RES_CODE_UNAVAILABLE, p.ec.Throw("callWithBreaker", wrapNotSent(err))
+		}
+
+		generations = append(generations, generation)
+	}
+
+	start := time.Now()
+	code, err := p.callImpl(ctx, serviceName, funcName, reqObj, respObj)
+	latency := time.Since(start)
+	for i, breaker := range breakers {
+		breaker.record(generations[i], code, err, latency)
+	}
+
+	return code, err
+}
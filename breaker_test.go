@@ -0,0 +1,251 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+const TEST_BREAKER_PEER_TYPE = uint32(13)
+
+func TestCircuitBreakerStates(t *testing.T) {
+	transitions := make([]uint8, 0)
+	lckTransitions := &sync.Mutex{}
+
+	cfg := NewBreakerConfig()
+	cfg.MinRequests = 2
+	cfg.OpenDuration = 50 * time.Millisecond
+	cfg.HalfOpenProbes = 2
+	cfg.OnStateChange = func(cb *CircuitBreaker, from uint8, to uint8) {
+		lckTransitions.Lock()
+		defer lckTransitions.Unlock()
+
+		transitions = append(transitions, to)
+	}
+
+	cb, err := NewCircuitBreaker("test", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	call := func(code int32, err error) error {
+		generation, allowErr := cb.allow()
+		if allowErr != nil {
+			return allowErr
+		}
+
+		cb.record(generation, code, err, 0)
+		return nil
+	}
+
+	// the canceled and the business errors are not failures
+	call(RES_CODE_CANCELLED, context.Canceled)
+	call(RES_CODE_INVALID_ARGUMENT, errors.New("bad"))
+	call(RES_CODE_SUCC, nil)
+	if cb.GetState() != BREAKER_STATE_CLOSED {
+		t.Fatalf("state %d, want closed", cb.GetState())
+	}
+
+	// closed -> open
+	call(RES_CODE_TIMEOUT, ErrPipelineCallTimeout)
+	call(RES_CODE_UNAVAILABLE, ErrPipelineTransportLost)
+	if cb.GetState() != BREAKER_STATE_OPEN || cb.IsAvailable() {
+		t.Fatalf("state %d, want open", cb.GetState())
+	}
+
+	if !errors.Is(call(RES_CODE_SUCC, nil), ErrCircuitOpen) {
+		t.Fatal("open breaker let a call pass")
+	}
+
+	// open -> half-open -> open by a failed probe
+	time.Sleep(cfg.OpenDuration)
+	if call(RES_CODE_UNAVAILABLE, ErrPipelineTransportLost) != nil || cb.GetState() != BREAKER_STATE_OPEN {
+		t.Fatalf("state %d after a failed probe, want open", cb.GetState())
+	}
+
+	// open -> half-open -> closed by the probes
+	time.Sleep(cfg.OpenDuration)
+	generation1, err1 := cb.allow()
+	generation2, err2 := cb.allow()
+	_, err3 := cb.allow()
+	if err1 != nil || err2 != nil || !errors.Is(err3, ErrCircuitOpen) {
+		t.Fatalf("half-open probes %v %v %v, want 2 allowed", err1, err2, err3)
+	}
+
+	cb.record(generation1, RES_CODE_SUCC, nil, 0)
+	if cb.GetState() != BREAKER_STATE_HALF_OPEN {
+		t.Fatalf("state %d after a probe, want half-open", cb.GetState())
+	}
+
+	cb.record(generation2, RES_CODE_SUCC, nil, 0)
+	if cb.GetState() != BREAKER_STATE_CLOSED {
+		t.Fatalf("state %d after the probes, want closed", cb.GetState())
+	}
+
+	want := []uint8{BREAKER_STATE_OPEN, BREAKER_STATE_HALF_OPEN, BREAKER_STATE_OPEN, BREAKER_STATE_HALF_OPEN, BREAKER_STATE_CLOSED}
+	lckTransitions.Lock()
+	defer lckTransitions.Unlock()
+
+	if len(transitions) != len(want) {
+		t.Fatalf("transitions %v, want %v", transitions, want)
+	}
+
+	for i := range want {
+		if transitions[i] != want[i] {
+			t.Fatalf("transitions %v, want %v", transitions, want)
+		}
+	}
+}
+
+func TestCircuitBreakerConfig(t *testing.T) {
+	_, err := NewCircuitBreaker("test", nil)
+	if !errors.Is(err, ErrBreakerConfigNil) {
+		t.Fatalf("nil config: %v", err)
+	}
+
+	for _, rate := range []float64{0, -0.5, 1.5} {
+		cfg := NewBreakerConfig()
+		cfg.FailureRate = rate
+		_, err = NewCircuitBreaker("test", cfg)
+		if !errors.Is(err, ErrBreakerRateBadVal) {
+			t.Fatalf("failure rate %v: %v", rate, err)
+		}
+
+		cfg = NewBreakerConfig()
+		cfg.SlowCallRate = rate
+		_, err = NewCircuitBreaker("test", cfg)
+		if !errors.Is(err, ErrBreakerRateBadVal) {
+			t.Fatalf("slow call rate %v: %v", rate, err)
+		}
+	}
+
+	// the 0 values are raised, the config itself is not changed
+	cfg := NewBreakerConfig()
+	cfg.Window = 0
+	cfg.MinRequests = 0
+	cfg.OpenDuration = 0
+	cfg.HalfOpenProbes = 0
+	cb, err := NewCircuitBreaker("test", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Window != 0 || cb.cfg.Window != RPC_BREAKER_MIN_WINDOW || cb.cfg.MinRequests != 1 || cb.cfg.HalfOpenProbes != 1 {
+		t.Fatalf("checked config %+v", cb.cfg)
+	}
+
+	// a half-open breaker with one probe can close
+	generation, _ := cb.allow()
+	cb.record(generation, RES_CODE_UNAVAILABLE, ErrPipelineTransportLost, 0)
+	generation, err = cb.allow()
+	if err != nil || cb.GetState() != BREAKER_STATE_HALF_OPEN {
+		t.Fatalf("state %d %v, want half-open", cb.GetState(), err)
+	}
+
+	cb.record(generation, RES_CODE_SUCC, nil, 0)
+	if cb.GetState() != BREAKER_STATE_CLOSED {
+		t.Fatalf("state %d, want closed", cb.GetState())
+	}
+}
+
+func TestPipelineCircuitBreaker(t *testing.T) {
+	down := &testEchoService{no: 1, bFail: 1}
+	up := &testEchoService{no: 2}
+	downPipeline := addTestClientPipeline(t, TEST_BREAKER_PEER_TYPE, 1, down)
+	addTestClientPipeline(t, TEST_BREAKER_PEER_TYPE, 2, up)
+
+	cfg := NewBreakerConfig()
+	cfg.MinRequests = 4
+	cfg.OpenDuration = 50 * time.Millisecond
+	cfg.HalfOpenProbes = 1
+	err := downPipeline.SetCircuitBreaker(cfg, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 4; i++ {
+		downPipeline.Call("Echo", "Say", &testReq{}, &testResp{})
+	}
+
+	// fail fast without sending
+	calls := down.getCalls()
+	code, err := downPipeline.Call("Echo", "Say", &testReq{}, &testResp{})
+	if !errors.Is(err, ErrCircuitOpen) || !IsNotSent(err) || code != RES_CODE_UNAVAILABLE || down.getCalls() != calls {
+		t.Fatalf("open breaker: %d %v", code, err)
+	}
+
+	// the peer with an open breaker is skipped
+	for i := 0; i < 4; i++ {
+		resp := &testResp{}
+		_, err = Client.CallType(TEST_BREAKER_PEER_TYPE, "Echo", "Say", &testReq{Msg: "a"}, resp)
+		if err != nil || resp.Msg != "2:a" {
+			t.Fatalf("resp %q %v, want %q", resp.Msg, err, "2:a")
+		}
+	}
+
+	// recovered, closed by the probe
+	down.setFail(false)
+	time.Sleep(cfg.OpenDuration)
+	_, err = downPipeline.Call("Echo", "Say", &testReq{}, &testResp{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if downPipeline.GetCircuitBreaker().GetState() != BREAKER_STATE_CLOSED ||
+		downPipeline.GetFuncCircuitBreaker("Echo", "Say").GetState() != BREAKER_STATE_CLOSED {
+		t.Fatal("breakers not closed")
+	}
+}
+
+func TestPipelineCircuitBreakerNotSent(t *testing.T) {
+	svc := &testEchoService{no: 1}
+	p := addTestClientPipeline(t, TEST_BREAKER_PEER_TYPE+1, 1, svc)
+
+	cfg := NewBreakerConfig()
+	cfg.MinRequests = 1
+	cfg.FailureRate = 1
+	cfg.OpenDuration = time.Minute
+	err := p.SetCircuitBreaker(cfg, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the request can not be marshaled
+	_, err = p.Call("Echo", "Say", make(chan int), &testResp{})
+	if err == nil || !IsNotSent(err) {
+		t.Fatalf("err %v, want not sent", err)
+	}
+
+	// all the serial No. are in use
+	p.SetHeaderVersion(RPC_HEADER_VER_1)
+	p.lckRequests.Lock()
+	for sno := uint32(1); sno <= RPC_MAX_SERIAL_NO_V1; sno++ {
+		p.mapSno2Req[sno] = nil
+	}
+
+	p.lckRequests.Unlock()
+	_, err = p.Call("Echo", "Say", &testReq{}, &testResp{})
+	p.lckRequests.Lock()
+	p.mapSno2Req = make(map[uint32]*Request)
+	p.lckRequests.Unlock()
+	if !errors.Is(err, ErrPipelineTooManyReqs) || !IsNotSent(err) {
+		t.Fatalf("err %v, want %v", err, ErrPipelineTooManyReqs)
+	}
+
+	if p.GetCircuitBreaker().GetState() != BREAKER_STATE_CLOSED || svc.getCalls() != 0 {
+		t.Fatalf("state %d after the calls not sent, want closed", p.GetCircuitBreaker().GetState())
+	}
+
+	// a real failure still trip it
+	svc.setFail(true)
+	p.Call("Echo", "Say", &testReq{}, &testResp{})
+	if p.GetCircuitBreaker().GetState() != BREAKER_STATE_OPEN {
+		t.Fatalf("state %d, want open", p.GetCircuitBreaker().GetState())
+	}
+}
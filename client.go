@@ -5,14 +5,17 @@
 package rpc
 
 import (
+	"context"
 	"errors"
+	"sort"
 	"sync"
 
 	"github.com/yxlib/yx"
 )
 
 var (
-	ErrServNotExist = errors.New("service not exist")
+	ErrServNotExist     = errors.New("service not exist")
+	ErrClientNoPipeline = errors.New("no available pipeline")
 )
 
 // type PipelineList = []*Pipeline
@@ -21,15 +24,34 @@ var (
 //               client
 //==========================================
 type client struct {
-	mapPeerId2Pipeline map[uint32]*Pipeline
-	lckPipelines       *sync.Mutex
-	ec                 *yx.ErrCatcher
+	mapPeerId2Pipeline   map[uint32]*Pipeline
+	mapPeerType2Balancer map[uint32]Balancer
+	lckPipelines         *sync.Mutex
+	middlewares          []ClientMiddleware
+	retryPolicy          *RetryPolicy
+	hedgePolicy          *HedgePolicy
+	ec                   *yx.ErrCatcher
 }
 
 var Client = &client{
-	mapPeerId2Pipeline: make(map[uint32]*Pipeline),
-	lckPipelines:       &sync.Mutex{},
-	ec:                 yx.NewErrCatcher("rpc.Client"),
+	mapPeerId2Pipeline:   make(map[uint32]*Pipeline),
+	mapPeerType2Balancer: make(map[uint32]Balancer),
+	lckPipelines:         &sync.Mutex{},
+	middlewares:          make([]ClientMiddleware, 0),
+	retryPolicy:          nil,
+	hedgePolicy:          nil,
+	ec:                   yx.NewErrCatcher("rpc.Client"),
+}
+
+// Add middlewares to wrap Call, CallType and CallNoReturn, they run outside the pipeline middlewares.
+func (c *client) Use(middlewares ...ClientMiddleware) {
+	c.middlewares = append(c.middlewares, middlewares...)
+}
+
+// Retry the failed Call and CallType by the policy, inside the client middlewares.
+// CallType retry on another peer if any. Not set it together with the pipeline one.
+func (c *client) SetRetryPolicy(policy *RetryPolicy) {
+	c.retryPolicy = policy
 }
 
 func (c *client) AddPipeline(net Net, peerType uint32, peerNo uint32, mark string, timeoutSec uint32) (*Pipeline, error) {
@@ -71,12 +93,150 @@ func (c *client) RemoveAllPipelines() {
 }
 
 func (c *client) Call(peerType uint32, peerNo uint32, service string, funcName string, reqObj interface{}, respObj interface{}) (int32, error) {
-	pipeline, ok := c.getPipeline(peerType, peerNo)
-	if ok {
-		return pipeline.Call(service, funcName, reqObj, respObj)
+	return c.CallContext(context.Background(), peerType, peerNo, service, funcName, reqObj, respObj)
+}
+
+func (c *client) CallContext(ctx context.Context, peerType uint32, peerNo uint32, service string, funcName string, reqObj interface{}, respObj interface{}) (int32, error) {
+	invoker := func(ctx context.Context, service string, funcName string, reqObj interface{}, respObj interface{}) (int32, error) {
+		pipeline, ok := c.getPipeline(peerType, peerNo)
+		if !ok {
+			return RES_CODE_SYS_ERR, ErrServNotExist
+		}
+
+		if c.retryPolicy == nil {
+			return pipeline.CallContext(ctx, service, funcName, reqObj, respObj)
+		}
+
+		return c.retryPolicy.run(ctx, service, funcName, func(attempt uint32) (int32, error) {
+			return pipeline.CallContext(ctx, service, funcName, reqObj, respObj)
+		})
 	}
 
-	return RES_CODE_SYS_ERR, ErrServNotExist
+	return ChainClientMiddlewares(invoker, c.middlewares...)(ctx, service, funcName, reqObj, respObj)
+}
+
+// Set the balancer of a peer type for CallType, RoundRobinBalancer by default.
+func (c *client) SetBalancer(peerType uint32, balancer Balancer) {
+	c.lckPipelines.Lock()
+	defer c.lckPipelines.Unlock()
+
+	c.mapPeerType2Balancer[peerType] = balancer
+}
+
+// Call a peer of the peer type chosen by the balancer,
+// the not connected and unhealthy pipelines are skipped.
+func (c *client) CallType(peerType uint32, service string, funcName string, reqObj interface{}, respObj interface{}) (int32, error) {
+	return c.CallTypeContext(context.Background(), peerType, service, funcName, reqObj, respObj)
+}
+
+func (c *client) CallTypeContext(ctx context.Context, peerType uint32, service string, funcName string, reqObj interface{}, respObj interface{}) (int32, error) {
+	invoker := func(ctx context.Context, service string, funcName string, reqObj interface{}, respObj interface{}) (int32, error) {
+		if c.shouldHedge(service, funcName, respObj) {
+			return c.hedgeCall(ctx, peerType, service, funcName, reqObj, respObj)
+		}
+
+		fullFuncName := GetFullFuncName(service, funcName)
+		if c.retryPolicy == nil {
+			pipeline, err := c.pickPipelineExcept(ctx, peerType, fullFuncName, nil)
+			if err != nil {
+				return RES_CODE_UNAVAILABLE, c.ec.Throw("CallTypeContext", err)
+			}
+
+			return pipeline.CallContext(ctx, service, funcName, reqObj, respObj)
+		}
+
+		mapTried := make(map[*Pipeline]bool)
+		return c.retryPolicy.run(ctx, service, funcName, func(attempt uint32) (int32, error) {
+			pipeline, err := c.pickPipelineExcept(ctx, peerType, fullFuncName, mapTried)
+			if err != nil {
+				return RES_CODE_UNAVAILABLE, wrapNotSent(err)
+			}
+
+			mapTried[pipeline] = true
+			return pipeline.CallContext(ctx, service, funcName, reqObj, respObj)
+		})
+	}
+
+	return ChainClientMiddlewares(invoker, c.middlewares...)(ctx, service, funcName, reqObj, respObj)
+}
+
+// Choose an available pipeline of the peer type by the balancer.
+// @param ctx, the context, with the key for ConsistentHashBalancer.
+// @param peerType, the peer type.
+// @return *Pipeline, the pipeline.
+// @return error, ErrClientNoPipeline if none is available,
+//         ErrCircuitOpen if the breakers of all the others are open.
+func (c *client) PickPipeline(ctx context.Context, peerType uint32) (*Pipeline, error) {
+	pipelines, balancer, err := c.getAvailablePipelines(peerType, "")
+	if err != nil {
+		return nil, c.ec.Throw("PickPipeline", err)
+	}
+
+	return balancer.Pick(ctx, pipelines), nil
+}
+
+// pick a pipeline not tried, or any one if all tried.
+// fullFuncName is used to skip the open func breakers, "" to check the pipeline ones only.
+func (c *client) pickPipelineExcept(ctx context.Context, peerType uint32, fullFuncName string, mapTried map[*Pipeline]bool) (*Pipeline, error) {
+	pipelines, balancer, err := c.getAvailablePipelines(peerType, fullFuncName)
+	if err != nil {
+		return nil, err
+	}
+
+	notTried := make([]*Pipeline, 0, len(pipelines))
+	for _, pipeline := range pipelines {
+		if !mapTried[pipeline] {
+			notTried = append(notTried, pipeline)
+		}
+	}
+
+	if len(notTried) > 0 {
+		pipelines = notTried
+	}
+
+	return balancer.Pick(ctx, pipelines), nil
+}
+
+// get the available pipelines of the peer type sorted by peer No., and the balancer.
+// The pipelines with open breakers are skipped.
+func (c *client) getAvailablePipelines(peerType uint32, fullFuncName string) ([]*Pipeline, Balancer, error) {
+	c.lckPipelines.Lock()
+	defer c.lckPipelines.Unlock()
+
+	pipelines := make([]*Pipeline, 0)
+	bBreakerOpen := false
+	for _, pipeline := range c.mapPeerId2Pipeline {
+		if pipeline.GetPeerType() != peerType || !pipeline.IsConnected() || !pipeline.IsHealthy() {
+			continue
+		}
+
+		if !pipeline.isBreakerAvailable(fullFuncName) {
+			bBreakerOpen = true
+			continue
+		}
+
+		pipelines = append(pipelines, pipeline)
+	}
+
+	if len(pipelines) == 0 {
+		if bBreakerOpen {
+			return nil, nil, ErrCircuitOpen
+		}
+
+		return nil, nil, ErrClientNoPipeline
+	}
+
+	sort.Slice(pipelines, func(i, j int) bool {
+		return pipelines[i].GetPeerNo() < pipelines[j].GetPeerNo()
+	})
+
+	balancer, ok := c.mapPeerType2Balancer[peerType]
+	if !ok {
+		balancer = NewRoundRobinBalancer()
+		c.mapPeerType2Balancer[peerType] = balancer
+	}
+
+	return pipelines, balancer, nil
 }
 
 func (c *client) AsyncCall(cb func(code int32, resp interface{}, err error), peerType uint32, peerNo uint32, service string, funcName string, reqObj interface{}, respObj interface{}) {
@@ -92,13 +252,22 @@ func (c *client) AsyncCall(cb func(code int32, resp interface{}, err error), pee
 }
 
 func (c *client) CallNoReturn(peerType uint32, peerNo uint32, service string, funcName string, reqObj interface{}) error {
-	pipeline, ok := c.getPipeline(peerType, peerNo)
-	if ok {
-		err := pipeline.CallNoReturn(service, funcName, reqObj)
-		return err
+	return c.CallNoReturnContext(context.Background(), peerType, peerNo, service, funcName, reqObj)
+}
+
+// The client and pipeline middlewares run with a nil respObj, no retry.
+func (c *client) CallNoReturnContext(ctx context.Context, peerType uint32, peerNo uint32, service string, funcName string, reqObj interface{}) error {
+	invoker := func(ctx context.Context, service string, funcName string, reqObj interface{}, respObj interface{}) (int32, error) {
+		pipeline, ok := c.getPipeline(peerType, peerNo)
+		if !ok {
+			return RES_CODE_SYS_ERR, ErrServNotExist
+		}
+
+		return pipeline.callNoReturnContext(ctx, service, funcName, reqObj)
 	}
 
-	return ErrServNotExist
+	_, err := ChainClientMiddlewares(invoker, c.middlewares...)(ctx, service, funcName, reqObj, nil)
+	return err
 }
 
 func (c *client) addPipeline(net Net, peerType uint32, peerNo uint32, mark string) (oldPipeline *Pipeline, newPipeline *Pipeline) {
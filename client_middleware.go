@@ -0,0 +1,39 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import "context"
+
+// Invoke a call.
+// @param ctx, the context.
+// @param serviceName, the service name.
+// @param funcName, the func name.
+// @param reqObj, the request object.
+// @param respObj, the response object.
+// @return int32, the response code.
+// @return error, error.
+type CallInvoker func(ctx context.Context, serviceName string, funcName string, reqObj interface{}, respObj interface{}) (int32, error)
+
+// Wrap a call, the middleware should call next to continue the call,
+// or return directly to short-circuit it.
+type ClientMiddleware func(ctx context.Context, serviceName string, funcName string, reqObj interface{}, respObj interface{}, next CallInvoker) (int32, error)
+
+// Chain the middlewares, the first one is the outermost.
+// @param invoker, the final invoker.
+// @param middlewares, the middlewares.
+// @return CallInvoker, the chained invoker.
+func ChainClientMiddlewares(invoker CallInvoker, middlewares ...ClientMiddleware) CallInvoker {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		invoker = wrapClientMiddleware(middlewares[i], invoker)
+	}
+
+	return invoker
+}
+
+func wrapClientMiddleware(middleware ClientMiddleware, next CallInvoker) CallInvoker {
+	return func(ctx context.Context, serviceName string, funcName string, reqObj interface{}, respObj interface{}) (int32, error) {
+		return middleware(ctx, serviceName, funcName, reqObj, respObj, next)
+	}
+}
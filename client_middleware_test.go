@@ -0,0 +1,168 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testMiddlewareLog record the middlewares in the order they run.
+type testMiddlewareLog struct {
+	lck   *sync.Mutex
+	steps []string
+}
+
+func newTestMiddlewareLog() *testMiddlewareLog {
+	return &testMiddlewareLog{
+		lck:   &sync.Mutex{},
+		steps: make([]string, 0),
+	}
+}
+
+func (l *testMiddlewareLog) add(step string) {
+	l.lck.Lock()
+	defer l.lck.Unlock()
+
+	l.steps = append(l.steps, step)
+}
+
+func (l *testMiddlewareLog) get() []string {
+	l.lck.Lock()
+	defer l.lck.Unlock()
+
+	return append([]string(nil), l.steps...)
+}
+
+func (l *testMiddlewareLog) middleware(name string) ClientMiddleware {
+	return func(ctx context.Context, serviceName string, funcName string, reqObj interface{}, respObj interface{}, next CallInvoker) (int32, error) {
+		l.add(name + ">")
+		code, err := next(ctx, serviceName, funcName, reqObj, respObj)
+		l.add("<" + name)
+		return code, err
+	}
+}
+
+func TestClientMiddlewareOrder(t *testing.T) {
+	svc := &testEchoService{no: 1}
+	srv, a, _ := newTestServer(t, RPC_HEADER_VER_1, svc)
+	p := newTestPipeline(t, RPC_HEADER_VER_1, srv, a)
+
+	log := newTestMiddlewareLog()
+	p.Use(log.middleware("a"), log.middleware("b"))
+
+	resp := &testResp{}
+	_, err := p.Call("Echo", "Say", &testReq{Msg: "a"}, resp)
+	if err != nil || resp.Msg != "1:a" {
+		t.Fatal(resp.Msg, err)
+	}
+
+	want := []string{"a>", "b>", "<b", "<a"}
+	if !reflect.DeepEqual(log.get(), want) {
+		t.Fatalf("Call steps %v, want %v", log.get(), want)
+	}
+
+	// CallNoReturn run through the same chain with a nil respObj
+	log = newTestMiddlewareLog()
+	var bRespNil bool
+	p.middlewares = []ClientMiddleware{
+		log.middleware("a"),
+		func(ctx context.Context, serviceName string, funcName string, reqObj interface{}, respObj interface{}, next CallInvoker) (int32, error) {
+			bRespNil = (respObj == nil)
+			return next(ctx, serviceName, funcName, reqObj, respObj)
+		},
+		log.middleware("b"),
+	}
+
+	err = p.CallNoReturn("Echo", "Say", &testReq{Msg: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(log.get(), want) || !bRespNil {
+		t.Fatalf("CallNoReturn steps %v, want %v, nil respObj %v", log.get(), want, bRespNil)
+	}
+
+	if !waitTestCond(time.Second, func() bool { return svc.getCalls() == 2 }) {
+		t.Fatalf("calls %d, want 2", svc.getCalls())
+	}
+}
+
+func TestClientMiddlewareShortCircuit(t *testing.T) {
+	svc := &testEchoService{no: 1}
+	srv, a, _ := newTestServer(t, RPC_HEADER_VER_1, svc)
+	p := newTestPipeline(t, RPC_HEADER_VER_1, srv, a)
+
+	errDenied := errors.New("denied")
+	log := newTestMiddlewareLog()
+	p.Use(
+		log.middleware("a"),
+		func(ctx context.Context, serviceName string, funcName string, reqObj interface{}, respObj interface{}, next CallInvoker) (int32, error) {
+			return RES_CODE_UNAVAILABLE, errDenied
+		},
+		log.middleware("b"),
+	)
+
+	code, err := p.Call("Echo", "Say", &testReq{Msg: "a"}, &testResp{})
+	if !errors.Is(err, errDenied) || code != RES_CODE_UNAVAILABLE {
+		t.Fatal(code, err)
+	}
+
+	err = p.CallNoReturn("Echo", "Say", &testReq{Msg: "b"})
+	if !errors.Is(err, errDenied) {
+		t.Fatal(err)
+	}
+
+	want := []string{"a>", "<a", "a>", "<a"}
+	if !reflect.DeepEqual(log.get(), want) {
+		t.Fatalf("steps %v, want %v", log.get(), want)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if svc.getCalls() != 0 {
+		t.Fatalf("calls %d, want 0", svc.getCalls())
+	}
+}
+
+func TestClientMiddlewareClient(t *testing.T) {
+	svc := &testEchoService{no: 3}
+	p := addTestClientPipeline(t, 30, 3, svc)
+
+	log := newTestMiddlewareLog()
+	p.Use(log.middleware("pipeline"))
+
+	oldMiddlewares := Client.middlewares
+	Client.Use(log.middleware("client"))
+	t.Cleanup(func() {
+		Client.middlewares = oldMiddlewares
+	})
+
+	resp := &testResp{}
+	_, err := Client.Call(30, 3, "Echo", "Say", &testReq{Msg: "a"}, resp)
+	if err != nil || resp.Msg != "3:a" {
+		t.Fatal(resp.Msg, err)
+	}
+
+	err = Client.CallNoReturn(30, 3, "Echo", "Say", &testReq{Msg: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the client middlewares are outside the pipeline ones
+	want := []string{"client>", "pipeline>", "<pipeline", "<client", "client>", "pipeline>", "<pipeline", "<client"}
+	if !reflect.DeepEqual(log.get(), want) {
+		t.Fatalf("steps %v, want %v", log.get(), want)
+	}
+
+	// the client middlewares run even without the pipeline
+	err = Client.CallNoReturn(30, 4, "Echo", "Say", &testReq{Msg: "c"})
+	if !errors.Is(err, ErrServNotExist) || len(log.get()) != len(want)+2 {
+		t.Fatal(log.get(), err)
+	}
+}
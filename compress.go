@@ -0,0 +1,283 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	ErrCompressNotExist   = errors.New("compressor not exist")
+	ErrCompressNeedV2     = errors.New("compression need header v2")
+	ErrCompressTooLarge   = errors.New("decompressed data too large")
+	ErrCompressTypeBroken = errors.New("compress type broken")
+)
+
+// compress types
+const (
+	COMPRESS_TYPE_NONE   uint8 = 0
+	COMPRESS_TYPE_GZIP   uint8 = 1
+	COMPRESS_TYPE_ZSTD   uint8 = 2
+	COMPRESS_TYPE_SNAPPY uint8 = 3
+)
+
+const (
+	RPC_DEFAULT_COMPRESS_THRESHOLD = uint32(1024)
+	RPC_MAX_DECOMPRESS_LEN         = 64 * 1024 * 1024
+)
+
+type Compressor interface {
+	GetType() uint8
+	Compress(data []byte) ([]byte, error)
+	// Decompress the data, ErrCompressTooLarge if longer than RPC_MAX_DECOMPRESS_LEN.
+	Decompress(data []byte) ([]byte, error)
+}
+
+var (
+	mapType2Compressor = map[uint8]Compressor{
+		COMPRESS_TYPE_GZIP:   &GzipCompressor{},
+		COMPRESS_TYPE_ZSTD:   &ZstdCompressor{once: &sync.Once{}},
+		COMPRESS_TYPE_SNAPPY: &SnappyCompressor{},
+	}
+	lckCompressors = &sync.RWMutex{}
+)
+
+// Register a compressor, replace the one with the same type.
+func RegisterCompressor(c Compressor) {
+	lckCompressors.Lock()
+	defer lckCompressors.Unlock()
+
+	mapType2Compressor[c.GetType()] = c
+}
+
+func GetCompressor(compressType uint8) (Compressor, bool) {
+	lckCompressors.RLock()
+	defer lckCompressors.RUnlock()
+
+	c, ok := mapType2Compressor[compressType]
+	return c, ok
+}
+
+//========================
+//         gzip
+//========================
+type GzipCompressor struct {
+}
+
+func (c *GzipCompressor) GetType() uint8 {
+	return COMPRESS_TYPE_GZIP
+}
+
+func (c *GzipCompressor) Compress(data []byte) ([]byte, error) {
+	buffWrap := &bytes.Buffer{}
+	w := gzip.NewWriter(buffWrap)
+	_, err := w.Write(data)
+	if err != nil {
+		return nil, err
+	}
+
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return buffWrap.Bytes(), nil
+}
+
+func (c *GzipCompressor) Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	defer r.Close()
+
+	out, err := ioutil.ReadAll(io.LimitReader(r, RPC_MAX_DECOMPRESS_LEN+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(out) > RPC_MAX_DECOMPRESS_LEN {
+		return nil, ErrCompressTooLarge
+	}
+
+	return out, nil
+}
+
+//========================
+//         zstd
+//========================
+type ZstdCompressor struct {
+	enc  *zstd.Encoder
+	dec  *zstd.Decoder
+	err  error
+	once *sync.Once
+}
+
+func (c *ZstdCompressor) GetType() uint8 {
+	return COMPRESS_TYPE_ZSTD
+}
+
+func (c *ZstdCompressor) Compress(data []byte) ([]byte, error) {
+	err := c.init()
+	if err != nil {
+		return nil, err
+	}
+
+	return c.enc.EncodeAll(data, nil), nil
+}
+
+func (c *ZstdCompressor) Decompress(data []byte) ([]byte, error) {
+	err := c.init()
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := c.dec.DecodeAll(data, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(out) > RPC_MAX_DECOMPRESS_LEN {
+		return nil, ErrCompressTooLarge
+	}
+
+	return out, nil
+}
+
+// the encoder and decoder are safe for concurrent EncodeAll / DecodeAll, create once.
+func (c *ZstdCompressor) init() error {
+	c.once.Do(func() {
+		c.enc, c.err = zstd.NewWriter(nil)
+		if c.err != nil {
+			return
+		}
+
+		c.dec, c.err = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(RPC_MAX_DECOMPRESS_LEN))
+	})
+
+	return c.err
+}
+
+//========================
+//        snappy
+//========================
+type SnappyCompressor struct {
+}
+
+func (c *SnappyCompressor) GetType() uint8 {
+	return COMPRESS_TYPE_SNAPPY
+}
+
+func (c *SnappyCompressor) Compress(data []byte) ([]byte, error) {
+	return snappy.Encode(nil, data), nil
+}
+
+func (c *SnappyCompressor) Decompress(data []byte) ([]byte, error) {
+	n, err := snappy.DecodedLen(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if n > RPC_MAX_DECOMPRESS_LEN {
+		return nil, ErrCompressTooLarge
+	}
+
+	return snappy.Decode(nil, data)
+}
+
+//========================
+//        header
+//========================
+// Set the compress type to the header, and compress the frames to one frame
+// if the total length is longer than threshold.
+func compressHeaderPayload(h *PackHeader, compressType uint8, threshold uint32, frames [][]byte) ([][]byte, error) {
+	if h.Version == RPC_HEADER_VER_1 {
+		return nil, ErrCompressNeedV2
+	}
+
+	c, ok := GetCompressor(compressType)
+	if !ok {
+		return nil, ErrCompressNotExist
+	}
+
+	h.SetExt(RPC_EXT_COMPRESS, []byte{compressType})
+
+	payloadLen := 0
+	for _, frame := range frames {
+		payloadLen += len(frame)
+	}
+
+	if payloadLen <= int(threshold) {
+		return frames, nil
+	}
+
+	payload := make([]byte, 0, payloadLen)
+	for _, frame := range frames {
+		payload = append(payload, frame...)
+	}
+
+	data, err := c.Compress(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	h.SetFlag(RPC_FLAG_COMPRESSED)
+	return [][]byte{data}, nil
+}
+
+// decompress the payload if RPC_FLAG_COMPRESSED is set.
+func decompressHeaderPayload(h *PackHeader, payload []byte) ([]byte, error) {
+	if !h.HasFlag(RPC_FLAG_COMPRESSED) {
+		return payload, nil
+	}
+
+	compressType, ok := getHeaderCompressType(h)
+	if !ok {
+		return nil, ErrCompressTypeBroken
+	}
+
+	c, ok := GetCompressor(compressType)
+	if !ok {
+		return nil, ErrCompressNotExist
+	}
+
+	return c.Decompress(payload)
+}
+
+// get the compress type of the header, the request one is also the type accepted for the response.
+func getHeaderCompressType(h *PackHeader) (uint8, bool) {
+	value, ok := h.GetExt(RPC_EXT_COMPRESS)
+	if !ok || len(value) != 1 {
+		return COMPRESS_TYPE_NONE, false
+	}
+
+	return value[0], true
+}
+
+//========================
+//       context
+//========================
+type compressTypeKey struct{}
+
+// Set the compress type of the calls made by ctx, override the one of Pipeline.
+// COMPRESS_TYPE_NONE disable the compression.
+func NewCompressContext(ctx context.Context, compressType uint8) context.Context {
+	return context.WithValue(ctx, compressTypeKey{}, compressType)
+}
+
+func fromCompressContext(ctx context.Context) (uint8, bool) {
+	compressType, ok := ctx.Value(compressTypeKey{}).(uint8)
+	return compressType, ok
+}
@@ -0,0 +1,147 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCompressorRoundTrip(t *testing.T) {
+	src := bytes.Repeat([]byte("yxlib rpc "), 1024)
+	for _, compressType := range []uint8{COMPRESS_TYPE_GZIP, COMPRESS_TYPE_ZSTD, COMPRESS_TYPE_SNAPPY} {
+		c, ok := GetCompressor(compressType)
+		if !ok || c.GetType() != compressType {
+			t.Fatalf("compressor %d not exist", compressType)
+		}
+
+		data, err := c.Compress(src)
+		if err != nil || len(data) >= len(src) {
+			t.Fatalf("compressor %d: len %d %v", compressType, len(data), err)
+		}
+
+		dst, err := c.Decompress(data)
+		if err != nil || !bytes.Equal(dst, src) {
+			t.Fatalf("compressor %d: %v", compressType, err)
+		}
+	}
+}
+
+func TestCompressorTooLarge(t *testing.T) {
+	if testing.Short() {
+		t.Skip("decompress 64MB")
+	}
+
+	// the gzip members and zstd frames are decompressed one after another
+	block := make([]byte, 1024*1024)
+	blockCount := RPC_MAX_DECOMPRESS_LEN/len(block) + 1
+	for _, compressType := range []uint8{COMPRESS_TYPE_GZIP, COMPRESS_TYPE_ZSTD} {
+		c, _ := GetCompressor(compressType)
+		frame, err := c.Compress(block)
+		if err != nil {
+			t.Fatal(compressType, err)
+		}
+
+		_, err = c.Decompress(bytes.Repeat(frame, blockCount))
+		if err == nil {
+			t.Fatalf("compressor %d: decompressed %d blocks", compressType, blockCount)
+		}
+	}
+
+	// the snappy block begin with the decoded length
+	c, _ := GetCompressor(COMPRESS_TYPE_SNAPPY)
+	data := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(data, uint64(RPC_MAX_DECOMPRESS_LEN+1))
+	_, err := c.Decompress(data[:n])
+	if !errors.Is(err, ErrCompressTooLarge) {
+		t.Fatalf("err %v, want %v", err, ErrCompressTooLarge)
+	}
+}
+
+func TestCompressHeaderPayload(t *testing.T) {
+	frames := [][]byte{[]byte("abc"), []byte("def")}
+
+	// not longer than the threshold, only the compress type is set
+	h := NewVersionPackHeader(RPC_HEADER_VER_2, TEST_MARK, 1, 1)
+	out, err := compressHeaderPayload(h, COMPRESS_TYPE_GZIP, 6, frames)
+	if err != nil || len(out) != 2 || h.HasFlag(RPC_FLAG_COMPRESSED) {
+		t.Fatal(out, err)
+	}
+
+	compressType, ok := getHeaderCompressType(h)
+	if !ok || compressType != COMPRESS_TYPE_GZIP {
+		t.Fatalf("compress type %d %v", compressType, ok)
+	}
+
+	// longer than the threshold, compressed to one frame
+	h = NewVersionPackHeader(RPC_HEADER_VER_2, TEST_MARK, 1, 1)
+	out, err = compressHeaderPayload(h, COMPRESS_TYPE_SNAPPY, 5, frames)
+	if err != nil || len(out) != 1 || !h.HasFlag(RPC_FLAG_COMPRESSED) {
+		t.Fatal(out, err)
+	}
+
+	payload, err := decompressHeaderPayload(h, out[0])
+	if err != nil || string(payload) != "abcdef" {
+		t.Fatalf("payload %q %v", payload, err)
+	}
+
+	h = NewVersionPackHeader(RPC_HEADER_VER_1, TEST_MARK, 1, 1)
+	_, err = compressHeaderPayload(h, COMPRESS_TYPE_GZIP, 0, frames)
+	if !errors.Is(err, ErrCompressNeedV2) {
+		t.Fatalf("err %v, want %v", err, ErrCompressNeedV2)
+	}
+
+	h = NewVersionPackHeader(RPC_HEADER_VER_2, TEST_MARK, 1, 1)
+	_, err = compressHeaderPayload(h, 0xFF, 0, frames)
+	if !errors.Is(err, ErrCompressNotExist) {
+		t.Fatalf("err %v, want %v", err, ErrCompressNotExist)
+	}
+
+	// the compressed flag without the compress type
+	h.SetFlag(RPC_FLAG_COMPRESSED)
+	_, err = decompressHeaderPayload(h, []byte("abc"))
+	if !errors.Is(err, ErrCompressTypeBroken) {
+		t.Fatalf("err %v, want %v", err, ErrCompressTypeBroken)
+	}
+}
+
+func TestCompressCall(t *testing.T) {
+	srv, a, _ := newTestServer(t, RPC_HEADER_VER_2, &testEchoService{no: 1})
+	p := newTestPipeline(t, RPC_HEADER_VER_2, srv, a)
+
+	err := p.SetCompression(COMPRESS_TYPE_ZSTD, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := strings.Repeat("a", 4096)
+	resp := &testResp{}
+	_, err = p.Call("Echo", "Say", &testReq{Msg: msg}, resp)
+	if err != nil || resp.Msg != "1:"+msg {
+		t.Fatal(len(resp.Msg), err)
+	}
+
+	// the context override the pipeline
+	ctx := NewCompressContext(context.Background(), COMPRESS_TYPE_GZIP)
+	_, err = p.CallContext(ctx, "Echo", "Say", &testReq{Msg: msg}, resp)
+	if err != nil || resp.Msg != "1:"+msg {
+		t.Fatal(len(resp.Msg), err)
+	}
+
+	// the serial No. is released if the payload is not built
+	ctx = NewCompressContext(context.Background(), 0xFF)
+	_, err = p.CallContext(ctx, "Echo", "Say", &testReq{Msg: msg}, resp)
+	if !errors.Is(err, ErrCompressNotExist) {
+		t.Fatalf("err %v, want %v", err, ErrCompressNotExist)
+	}
+
+	if p.GetPendingCount() != 0 {
+		t.Fatalf("pending %d, want 0", p.GetPendingCount())
+	}
+}
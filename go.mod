@@ -2,4 +2,10 @@ module github.com/yxlib/rpc
 
 go 1.16
 
-require github.com/yxlib/yx v0.3.7
+require (
+	github.com/fxamacker/cbor/v2 v2.5.0
+	github.com/klauspost/compress v1.15.9
+	github.com/vmihailenco/msgpack/v5 v5.3.5
+	github.com/yxlib/yx v0.3.7
+	google.golang.org/protobuf v1.28.1
+)
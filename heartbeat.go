@@ -0,0 +1,106 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Send a heartbeat every interval, after maxMiss heartbeats fail in a row the pipeline
+// is marked unhealthy, and the net is closed to reconnect if a net factory is set.
+// A successful heartbeat mark it healthy again.
+// @param interval, the interval, also the timeout of each heartbeat, 0 to disable.
+// @param maxMiss, the max failed heartbeats in a row, at least 1.
+func (p *Pipeline) SetHeartbeat(interval time.Duration, maxMiss uint32) {
+	p.lckHeartbeat.Lock()
+	defer p.lckHeartbeat.Unlock()
+
+	if p.chanHbStop != nil {
+		close(p.chanHbStop)
+		p.chanHbStop = nil
+	}
+
+	if interval <= 0 {
+		return
+	}
+
+	if maxMiss == 0 {
+		maxMiss = 1
+	}
+
+	p.chanHbStop = make(chan struct{})
+	go p.heartbeatLoop(interval, maxMiss, p.chanHbStop)
+}
+
+// Get the round trip time of the last successful heartbeat or Ping, 0 if none.
+func (p *Pipeline) GetRTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&p.rtt))
+}
+
+// Send a heartbeat and wait the answer.
+// @param ctx, the context.
+// @return time.Duration, the round trip time.
+// @return error, error.
+func (p *Pipeline) Ping(ctx context.Context) (time.Duration, error) {
+	startTime := time.Now()
+	code, payload, respHeader, err := p.callByFuncNo(ctx, RPC_FUNC_NO_HEARTBEAT, false)
+	if err != nil {
+		return 0, p.ec.Throw("Ping", err)
+	}
+
+	if code != RES_CODE_SUCC {
+		return 0, p.ec.Throw("Ping", DecodeRpcError(respHeader, payload))
+	}
+
+	rtt := time.Since(startTime)
+	atomic.StoreInt64(&p.rtt, int64(rtt))
+	return rtt, nil
+}
+
+func (p *Pipeline) heartbeatLoop(interval time.Duration, maxMiss uint32, chanHbStop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	miss := uint32(0)
+	for {
+		select {
+		case <-ticker.C:
+		case <-chanHbStop:
+			return
+		case <-p.chanStop:
+			return
+		}
+
+		// the reconnect has its own detection
+		if !p.IsConnected() {
+			miss = 0
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		_, err := p.Ping(ctx)
+		cancel()
+		if err == nil {
+			miss = 0
+			p.SetHealthy(true)
+			continue
+		}
+
+		miss++
+		if miss < maxMiss {
+			continue
+		}
+
+		p.logger.W(fmt.Sprintf("heartbeat miss %d times", miss))
+		miss = 0
+		p.SetHealthy(false)
+		if p.hasNetFactory() {
+			p.getNet().Close()
+		}
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHeartbeat(t *testing.T) {
+	srv, a, _ := newTestServer(t, RPC_HEADER_VER_2, &testEchoService{no: 1})
+
+	// fail the heartbeats while bDrop is 1, they do not run through the middlewares
+	var bDrop int32
+	r := srv.GetRegistry()
+	r.mapFuncNo2Handler[RPC_FUNC_NO_HEARTBEAT] = func(ctx context.Context, req *ServerRequest) (int32, []byte, error) {
+		if atomic.LoadInt32(&bDrop) == 1 {
+			return RES_CODE_UNAVAILABLE, nil, NewRpcError(RES_CODE_UNAVAILABLE, "drop")
+		}
+
+		return r.handleHeartbeat(ctx, req)
+	}
+
+	p := newTestPipeline(t, RPC_HEADER_VER_2, srv, a)
+	rtt, err := p.Ping(context.Background())
+	if err != nil || rtt <= 0 || p.GetRTT() != rtt {
+		t.Fatal(rtt, p.GetRTT(), err)
+	}
+
+	p.SetHeartbeat(20*time.Millisecond, 2)
+	t.Cleanup(func() {
+		p.SetHeartbeat(0, 0)
+	})
+
+	// the missed heartbeats mark the pipeline unhealthy, the net is kept without a factory
+	atomic.StoreInt32(&bDrop, 1)
+	if !waitTestCond(time.Second, func() bool { return !p.IsHealthy() }) {
+		t.Fatal("still healthy after the heartbeats missed")
+	}
+
+	if !p.IsConnected() {
+		t.Fatalf("state %d, want connected", p.GetState())
+	}
+
+	_, err = p.Ping(context.Background())
+	if GetErrorCode(err) != RES_CODE_UNAVAILABLE {
+		t.Fatalf("err %v, want code %d", err, RES_CODE_UNAVAILABLE)
+	}
+
+	// a later heartbeat restore it
+	atomic.StoreInt32(&bDrop, 0)
+	if !waitTestCond(time.Second, p.IsHealthy) {
+		t.Fatal("still unhealthy after the heartbeat succeeded")
+	}
+}
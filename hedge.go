@@ -0,0 +1,183 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"time"
+)
+
+//========================
+//      HedgePolicy
+//========================
+// HedgePolicy send the same call to another peer if no response arrive within the delay,
+// the first success is taken and the others are canceled.
+// Only the hedgeable (read-only) funcs are hedged.
+type HedgePolicy struct {
+	// the delay before sending to the next peer
+	Delay time.Duration
+	// the max attempts including the first one
+	MaxAttempts uint32
+
+	mapFuncName2Hedgeable map[string]bool
+	lck                   *sync.Mutex
+}
+
+// Create a hedge policy.
+// @param delay, the delay before sending to the next peer.
+// @param maxAttempts, the max attempts including the first one.
+// @return *HedgePolicy, the policy.
+func NewHedgePolicy(delay time.Duration, maxAttempts uint32) *HedgePolicy {
+	return &HedgePolicy{
+		Delay:       delay,
+		MaxAttempts: maxAttempts,
+
+		mapFuncName2Hedgeable: make(map[string]bool),
+		lck:                   &sync.Mutex{},
+	}
+}
+
+// Mark a func hedgeable, it must be read-only since it may run on several peers.
+func (hp *HedgePolicy) SetHedgeable(serviceName string, funcName string, bHedgeable bool) {
+	hp.lck.Lock()
+	defer hp.lck.Unlock()
+
+	hp.mapFuncName2Hedgeable[GetFullFuncName(serviceName, funcName)] = bHedgeable
+}
+
+func (hp *HedgePolicy) IsHedgeable(serviceName string, funcName string) bool {
+	hp.lck.Lock()
+	defer hp.lck.Unlock()
+
+	return hp.mapFuncName2Hedgeable[GetFullFuncName(serviceName, funcName)]
+}
+
+//========================
+//        client
+//========================
+type hedgeResult struct {
+	code    int32
+	respObj interface{}
+	err     error
+}
+
+// Hedge the hedgeable calls of CallType by the policy, inside the client middlewares.
+// The hedged calls are not retried by the retry policy. nil to disable.
+func (c *client) SetHedgePolicy(policy *HedgePolicy) {
+	c.hedgePolicy = policy
+}
+
+func (c *client) shouldHedge(service string, funcName string, respObj interface{}) bool {
+	if c.hedgePolicy == nil || c.hedgePolicy.MaxAttempts <= 1 || !c.hedgePolicy.IsHedgeable(service, funcName) {
+		return false
+	}
+
+	if respObj == nil {
+		return true
+	}
+
+	// each attempt need its own response object, a nil pointer has nothing to copy into
+	v := reflect.ValueOf(respObj)
+	return v.Kind() == reflect.Ptr && !v.IsNil()
+}
+
+// call the peers of the peer type one by one every delay, or at once after a failure,
+// until the first success or all failed.
+func (c *client) hedgeCall(ctx context.Context, peerType uint32, service string, funcName string, reqObj interface{}, respObj interface{}) (int32, error) {
+	hp := c.hedgePolicy
+
+	// cancel the rest when return, their requests are removed from the pipelines
+	ctxHedge, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	chanResult := make(chan *hedgeResult, hp.MaxAttempts)
+	mapTried := make(map[*Pipeline]bool)
+	startAttempt := func() error {
+		pipeline, err := c.pickPipelineExcept(ctx, peerType, GetFullFuncName(service, funcName), mapTried)
+		if err != nil {
+			return err
+		}
+
+		if mapTried[pipeline] {
+			return ErrClientNoPipeline
+		}
+
+		mapTried[pipeline] = true
+		attemptRespObj := newHedgeRespObj(respObj)
+		go func() {
+			code, err := pipeline.CallContext(ctxHedge, service, funcName, reqObj, attemptRespObj)
+			chanResult <- &hedgeResult{code: code, respObj: attemptRespObj, err: err}
+		}()
+
+		return nil
+	}
+
+	err := startAttempt()
+	if err != nil {
+		return RES_CODE_UNAVAILABLE, c.ec.Throw("hedgeCall", err)
+	}
+
+	attempts := uint32(1)
+	running := 1
+	timer := time.NewTimer(hp.Delay)
+	defer timer.Stop()
+
+	var lastResult *hedgeResult = nil
+	for running > 0 {
+		select {
+		case <-timer.C:
+			if attempts < hp.MaxAttempts && startAttempt() == nil {
+				attempts++
+				running++
+				timer.Reset(hp.Delay)
+			}
+
+		case result := <-chanResult:
+			running--
+			if result.err == nil {
+				copyHedgeRespObj(respObj, result.respObj)
+				return result.code, nil
+			}
+
+			lastResult = result
+			if ctx.Err() != nil {
+				continue
+			}
+
+			if attempts < hp.MaxAttempts && startAttempt() == nil {
+				attempts++
+				running++
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+
+				timer.Reset(hp.Delay)
+			}
+		}
+	}
+
+	return lastResult.code, lastResult.err
+}
+
+func newHedgeRespObj(respObj interface{}) interface{} {
+	if respObj == nil {
+		return nil
+	}
+
+	return reflect.New(reflect.TypeOf(respObj).Elem()).Interface()
+}
+
+func copyHedgeRespObj(dst interface{}, src interface{}) {
+	if dst == nil {
+		return
+	}
+
+	reflect.ValueOf(dst).Elem().Set(reflect.ValueOf(src).Elem())
+}
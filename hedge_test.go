@@ -0,0 +1,67 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"testing"
+	"time"
+)
+
+const TEST_HEDGE_PEER_TYPE = uint32(12)
+
+func TestHedgeCall(t *testing.T) {
+	slow := &testEchoService{no: 1, delay: 300 * time.Millisecond}
+	fast := &testEchoService{no: 2}
+	slowPipeline := addTestClientPipeline(t, TEST_HEDGE_PEER_TYPE, 1, slow)
+	addTestClientPipeline(t, TEST_HEDGE_PEER_TYPE, 2, fast)
+
+	policy := NewHedgePolicy(20*time.Millisecond, 2)
+	policy.SetHedgeable("Echo", "Say", true)
+	Client.SetHedgePolicy(policy)
+	t.Cleanup(func() {
+		Client.SetHedgePolicy(nil)
+	})
+
+	for i := 0; i < 4; i++ {
+		start := time.Now()
+		resp := &testResp{}
+		_, err := Client.CallType(TEST_HEDGE_PEER_TYPE, "Echo", "Say", &testReq{Msg: "a"}, resp)
+		if err != nil || resp.Msg != "2:a" {
+			t.Fatalf("resp %q %v, want %q", resp.Msg, err, "2:a")
+		}
+
+		if time.Since(start) >= slow.delay {
+			t.Fatalf("hedged call take %v", time.Since(start))
+		}
+
+		// the loser is removed from the pipeline
+		if !waitTestCond(100*time.Millisecond, func() bool { return slowPipeline.GetPendingCount() == 0 }) {
+			t.Fatalf("loser left, pending %d", slowPipeline.GetPendingCount())
+		}
+	}
+
+	if slow.getCalls() == 0 {
+		t.Fatal("slow peer never tried")
+	}
+}
+
+func TestHedgeSkipNilPointer(t *testing.T) {
+	policy := NewHedgePolicy(time.Millisecond, 2)
+	policy.SetHedgeable("Echo", "Say", true)
+	c := &client{hedgePolicy: policy}
+
+	var resp *testResp = nil
+	if c.shouldHedge("Echo", "Say", resp) {
+		t.Fatal("nil pointer response object hedged")
+	}
+
+	if !c.shouldHedge("Echo", "Say", &testResp{}) || !c.shouldHedge("Echo", "Say", nil) {
+		t.Fatal("response object not hedged")
+	}
+
+	if c.shouldHedge("Echo", "Other", &testResp{}) {
+		t.Fatal("not hedgeable func hedged")
+	}
+}
@@ -58,9 +58,31 @@ type Interceptor interface {
 	OnUnmarshal(funcName string, data []byte, obj interface{}) error
 }
 
+// codec names
+const (
+	CODEC_NAME_JSON    = "json"
+	CODEC_NAME_PROTO   = "proto"
+	CODEC_NAME_MSGPACK = "msgpack"
+	CODEC_NAME_CBOR    = "cbor"
+	CODEC_NAME_RAW     = "raw"
+)
+
+// Codec is a named Interceptor, which can be negotiated with the peer.
+type Codec interface {
+	Interceptor
+
+	// Get the codec name.
+	// @return string, the name.
+	GetName() string
+}
+
 type JsonInterceptor struct {
 }
 
+func (i *JsonInterceptor) GetName() string {
+	return CODEC_NAME_JSON
+}
+
 func (i *JsonInterceptor) OnMarshal(funcName string, reqObj interface{}) ([]byte, error) {
 	payload, err := json.Marshal(reqObj)
 	return payload, err
@@ -0,0 +1,24 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"github.com/fxamacker/cbor/v2"
+)
+
+type CborInterceptor struct {
+}
+
+func (i *CborInterceptor) GetName() string {
+	return CODEC_NAME_CBOR
+}
+
+func (i *CborInterceptor) OnMarshal(funcName string, reqObj interface{}) ([]byte, error) {
+	return cbor.Marshal(reqObj)
+}
+
+func (i *CborInterceptor) OnUnmarshal(funcName string, respData []byte, respObj interface{}) error {
+	return cbor.Unmarshal(respData, respObj)
+}
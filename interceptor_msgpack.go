@@ -0,0 +1,24 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+type MsgpackInterceptor struct {
+}
+
+func (i *MsgpackInterceptor) GetName() string {
+	return CODEC_NAME_MSGPACK
+}
+
+func (i *MsgpackInterceptor) OnMarshal(funcName string, reqObj interface{}) ([]byte, error) {
+	return msgpack.Marshal(reqObj)
+}
+
+func (i *MsgpackInterceptor) OnUnmarshal(funcName string, respData []byte, respObj interface{}) error {
+	return msgpack.Unmarshal(respData, respObj)
+}
@@ -0,0 +1,150 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"errors"
+	"fmt"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+var (
+	ErrProtoInterNotProtoMsg  = errors.New("object is not a proto.Message")
+	ErrProtoInterDataBroken   = errors.New("proto data broken")
+	ErrProtoInterFuncNoTooBig = errors.New("func No. out of range")
+)
+
+// FetchFuncListResp is encoded as
+// message FetchFuncListResp { map<string, uint32> func_mapper = 1; }
+const (
+	PROTO_FIELD_FUNC_MAPPER   protowire.Number = 1
+	PROTO_FIELD_MAP_ENTRY_KEY protowire.Number = 1
+	PROTO_FIELD_MAP_ENTRY_VAL protowire.Number = 2
+)
+
+type ProtoInterceptor struct {
+}
+
+func (i *ProtoInterceptor) GetName() string {
+	return CODEC_NAME_PROTO
+}
+
+func (i *ProtoInterceptor) OnMarshal(funcName string, reqObj interface{}) ([]byte, error) {
+	funcListResp, ok := reqObj.(*FetchFuncListResp)
+	if ok {
+		return marshalFuncListProto(funcListResp), nil
+	}
+
+	msg, ok := reqObj.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s got %T", ErrProtoInterNotProtoMsg, funcName, reqObj)
+	}
+
+	return proto.Marshal(msg)
+}
+
+func (i *ProtoInterceptor) OnUnmarshal(funcName string, respData []byte, respObj interface{}) error {
+	funcListResp, ok := respObj.(*FetchFuncListResp)
+	if ok {
+		return unmarshalFuncListProto(respData, funcListResp)
+	}
+
+	msg, ok := respObj.(proto.Message)
+	if !ok {
+		return fmt.Errorf("%w: %s got %T", ErrProtoInterNotProtoMsg, funcName, respObj)
+	}
+
+	return proto.Unmarshal(respData, msg)
+}
+
+func marshalFuncListProto(resp *FetchFuncListResp) []byte {
+	buff := make([]byte, 0)
+	for name, funcNo := range resp.MapFuncName2No {
+		entry := make([]byte, 0)
+		entry = protowire.AppendTag(entry, PROTO_FIELD_MAP_ENTRY_KEY, protowire.BytesType)
+		entry = protowire.AppendString(entry, name)
+		entry = protowire.AppendTag(entry, PROTO_FIELD_MAP_ENTRY_VAL, protowire.VarintType)
+		entry = protowire.AppendVarint(entry, uint64(funcNo))
+
+		buff = protowire.AppendTag(buff, PROTO_FIELD_FUNC_MAPPER, protowire.BytesType)
+		buff = protowire.AppendBytes(buff, entry)
+	}
+
+	return buff
+}
+
+func unmarshalFuncListProto(data []byte, resp *FetchFuncListResp) error {
+	resp.MapFuncName2No = make(map[string]uint16)
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return ErrProtoInterDataBroken
+		}
+
+		data = data[n:]
+		if num != PROTO_FIELD_FUNC_MAPPER || typ != protowire.BytesType {
+			n = protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return ErrProtoInterDataBroken
+			}
+
+			data = data[n:]
+			continue
+		}
+
+		entry, n := protowire.ConsumeBytes(data)
+		if n < 0 {
+			return ErrProtoInterDataBroken
+		}
+
+		data = data[n:]
+		name, funcNo, err := unmarshalFuncListEntryProto(entry)
+		if err != nil {
+			return err
+		}
+
+		resp.MapFuncName2No[name] = funcNo
+	}
+
+	return nil
+}
+
+func unmarshalFuncListEntryProto(entry []byte) (string, uint16, error) {
+	name := ""
+	funcNo := uint64(0)
+	for len(entry) > 0 {
+		num, typ, n := protowire.ConsumeTag(entry)
+		if n < 0 {
+			return "", 0, ErrProtoInterDataBroken
+		}
+
+		entry = entry[n:]
+		switch {
+		case num == PROTO_FIELD_MAP_ENTRY_KEY && typ == protowire.BytesType:
+			name, n = protowire.ConsumeString(entry)
+
+		case num == PROTO_FIELD_MAP_ENTRY_VAL && typ == protowire.VarintType:
+			funcNo, n = protowire.ConsumeVarint(entry)
+
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, entry)
+		}
+
+		if n < 0 {
+			return "", 0, ErrProtoInterDataBroken
+		}
+
+		entry = entry[n:]
+	}
+
+	// a non-Go peer may send a value out of uint16
+	if funcNo > uint64(RPC_MAX_FUNC_NO) {
+		return "", 0, ErrProtoInterFuncNoTooBig
+	}
+
+	return name, uint16(funcNo), nil
+}
@@ -0,0 +1,100 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// testProtoService is registered as "Proto", Upper answer "1:<Value>".
+type testProtoService struct {
+}
+
+func (s *testProtoService) Upper(ctx context.Context, req *wrapperspb.StringValue) (*wrapperspb.StringValue, error) {
+	return wrapperspb.String("1:" + req.GetValue()), nil
+}
+
+func TestProtoInterceptorFuncList(t *testing.T) {
+	inter := &ProtoInterceptor{}
+	src := &FetchFuncListResp{MapFuncName2No: map[string]uint16{"Echo.Say": 1, "Proto.Upper": RPC_MAX_FUNC_NO}}
+	data, err := inter.OnMarshal(RPC_FUNC_NAME_FUNC_LIST, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst := &FetchFuncListResp{}
+	err = inter.OnUnmarshal(RPC_FUNC_NAME_FUNC_LIST, data, dst)
+	if err != nil || !reflect.DeepEqual(dst.MapFuncName2No, src.MapFuncName2No) {
+		t.Fatal(dst.MapFuncName2No, err)
+	}
+
+	// func No. out of uint16
+	entry := protowire.AppendTag(nil, PROTO_FIELD_MAP_ENTRY_KEY, protowire.BytesType)
+	entry = protowire.AppendString(entry, "Echo.Say")
+	entry = protowire.AppendTag(entry, PROTO_FIELD_MAP_ENTRY_VAL, protowire.VarintType)
+	entry = protowire.AppendVarint(entry, uint64(RPC_MAX_FUNC_NO)+1)
+	data = protowire.AppendTag(nil, PROTO_FIELD_FUNC_MAPPER, protowire.BytesType)
+	data = protowire.AppendBytes(data, entry)
+	err = inter.OnUnmarshal(RPC_FUNC_NAME_FUNC_LIST, data, dst)
+	if !errors.Is(err, ErrProtoInterFuncNoTooBig) {
+		t.Fatalf("err %v, want %v", err, ErrProtoInterFuncNoTooBig)
+	}
+
+	err = inter.OnUnmarshal(RPC_FUNC_NAME_FUNC_LIST, data[:len(data)-1], dst)
+	if !errors.Is(err, ErrProtoInterDataBroken) {
+		t.Fatalf("err %v, want %v", err, ErrProtoInterDataBroken)
+	}
+}
+
+func TestProtoInterceptorNotProtoMsg(t *testing.T) {
+	inter := &ProtoInterceptor{}
+	_, err := inter.OnMarshal("Echo.Say", &testReq{})
+	if !errors.Is(err, ErrProtoInterNotProtoMsg) {
+		t.Fatalf("err %v, want %v", err, ErrProtoInterNotProtoMsg)
+	}
+
+	err = inter.OnUnmarshal("Echo.Say", nil, &testResp{})
+	if !errors.Is(err, ErrProtoInterNotProtoMsg) {
+		t.Fatalf("err %v, want %v", err, ErrProtoInterNotProtoMsg)
+	}
+}
+
+func TestProtoInterceptorCall(t *testing.T) {
+	srv, a, _ := newTestServer(t, RPC_HEADER_VER_2, nil)
+	srv.SetInterceptor(&ProtoInterceptor{})
+	err := srv.RegisterService("Proto", &testProtoService{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go srv.Start()
+	t.Cleanup(srv.Stop)
+
+	p := NewPipeline(a, TEST_SERVER_PEER_TYPE, TEST_SERVER_PEER_NO, TEST_MARK)
+	p.SetInterceptor(&ProtoInterceptor{})
+	go p.Start()
+	t.Cleanup(p.Stop)
+
+	err = p.FetchFuncList()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := &wrapperspb.StringValue{}
+	code, err := p.Call("Proto", "Upper", wrapperspb.String("a"), resp)
+	if err != nil || code != RES_CODE_SUCC {
+		t.Fatal(code, err)
+	}
+
+	if resp.GetValue() != "1:a" {
+		t.Fatalf("resp %q, want %q", resp.GetValue(), "1:a")
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrRouteInterNotExist = errors.New("no interceptor for this func")
+	ErrRawInterNotBytes   = errors.New("object is not []byte or *[]byte")
+	ErrRawInterNilBytes   = errors.New("object is a nil *[]byte")
+)
+
+//========================
+//    RouteInterceptor
+//========================
+// RouteInterceptor choose the interceptor by the full func name,
+// the func interceptor first, then the service interceptor, then the default one.
+type RouteInterceptor struct {
+	defInter          Interceptor
+	mapFuncName2Inter map[string]Interceptor
+	mapService2Inter  map[string]Interceptor
+	lck               *sync.RWMutex
+}
+
+func NewRouteInterceptor(defInter Interceptor) *RouteInterceptor {
+	return &RouteInterceptor{
+		defInter:          defInter,
+		mapFuncName2Inter: make(map[string]Interceptor),
+		mapService2Inter:  make(map[string]Interceptor),
+		lck:               &sync.RWMutex{},
+	}
+}
+
+func (i *RouteInterceptor) SetDefaultInterceptor(inter Interceptor) {
+	i.lck.Lock()
+	defer i.lck.Unlock()
+
+	i.defInter = inter
+}
+
+func (i *RouteInterceptor) GetDefaultInterceptor() Interceptor {
+	i.lck.RLock()
+	defer i.lck.RUnlock()
+
+	return i.defInter
+}
+
+func (i *RouteInterceptor) SetFuncInterceptor(serviceName string, funcName string, inter Interceptor) {
+	i.lck.Lock()
+	defer i.lck.Unlock()
+
+	i.mapFuncName2Inter[GetFullFuncName(serviceName, funcName)] = inter
+}
+
+// Set the interceptor of all the funcs of the service,
+// the service name can be a prefix like "Admin" for "Admin.User.Get".
+func (i *RouteInterceptor) SetServiceInterceptor(serviceName string, inter Interceptor) {
+	i.lck.Lock()
+	defer i.lck.Unlock()
+
+	i.mapService2Inter[serviceName] = inter
+}
+
+// Get the interceptor of a func.
+// @param funcName, the full func name.
+// @return Interceptor, the interceptor, nil if not exist.
+func (i *RouteInterceptor) GetInterceptor(funcName string) Interceptor {
+	i.lck.RLock()
+	defer i.lck.RUnlock()
+
+	inter, ok := i.mapFuncName2Inter[funcName]
+	if ok {
+		return inter
+	}
+
+	// the longest service prefix
+	matchLen := -1
+	for serviceName, serviceInter := range i.mapService2Inter {
+		if len(serviceName) > matchLen && strings.HasPrefix(funcName, serviceName+".") {
+			inter = serviceInter
+			matchLen = len(serviceName)
+		}
+	}
+
+	if matchLen >= 0 {
+		return inter
+	}
+
+	return i.defInter
+}
+
+func (i *RouteInterceptor) OnMarshal(funcName string, reqObj interface{}) ([]byte, error) {
+	inter := i.GetInterceptor(funcName)
+	if inter == nil {
+		return nil, fmt.Errorf("%w: %s", ErrRouteInterNotExist, funcName)
+	}
+
+	return inter.OnMarshal(funcName, reqObj)
+}
+
+func (i *RouteInterceptor) OnUnmarshal(funcName string, respData []byte, respObj interface{}) error {
+	inter := i.GetInterceptor(funcName)
+	if inter == nil {
+		return fmt.Errorf("%w: %s", ErrRouteInterNotExist, funcName)
+	}
+
+	return inter.OnUnmarshal(funcName, respData, respObj)
+}
+
+//========================
+//     RawInterceptor
+//========================
+// RawInterceptor pass the bytes through, the object should be []byte or *[]byte.
+type RawInterceptor struct {
+}
+
+func (i *RawInterceptor) GetName() string {
+	return CODEC_NAME_RAW
+}
+
+func (i *RawInterceptor) OnMarshal(funcName string, reqObj interface{}) ([]byte, error) {
+	switch data := reqObj.(type) {
+	case []byte:
+		return data, nil
+
+	case *[]byte:
+		if data == nil {
+			return nil, fmt.Errorf("%w: %s", ErrRawInterNilBytes, funcName)
+		}
+
+		return *data, nil
+
+	default:
+		return nil, fmt.Errorf("%w: %s got %T", ErrRawInterNotBytes, funcName, reqObj)
+	}
+}
+
+func (i *RawInterceptor) OnUnmarshal(funcName string, respData []byte, respObj interface{}) error {
+	data, ok := respObj.(*[]byte)
+	if !ok {
+		return fmt.Errorf("%w: %s got %T", ErrRawInterNotBytes, funcName, respObj)
+	}
+
+	if data == nil {
+		return fmt.Errorf("%w: %s", ErrRawInterNilBytes, funcName)
+	}
+
+	*data = append((*data)[:0], respData...)
+	return nil
+}
@@ -0,0 +1,136 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestRouteInterceptorChoose(t *testing.T) {
+	json := &JsonInterceptor{}
+	msgpack := &MsgpackInterceptor{}
+	cbor := &CborInterceptor{}
+	raw := &RawInterceptor{}
+
+	route := NewRouteInterceptor(json)
+	route.SetServiceInterceptor("Admin", msgpack)
+	route.SetServiceInterceptor("Admin.User", cbor)
+	route.SetFuncInterceptor("Admin.User", "Avatar", raw)
+
+	cases := []struct {
+		funcName string
+		inter    Interceptor
+	}{
+		{"Echo.Say", json},
+		{"Admin.Login", msgpack},
+		{"Admin.User.Get", cbor},
+		{"Admin.User.Avatar", raw},
+		{"AdminX.Login", json},
+	}
+
+	for _, c := range cases {
+		inter := route.GetInterceptor(c.funcName)
+		if inter != c.inter {
+			t.Fatalf("%s: %T, want %T", c.funcName, inter, c.inter)
+		}
+	}
+
+	// the routed func is marshaled by its interceptor
+	data, err := route.OnMarshal("Admin.User.Avatar", []byte("PNG"))
+	if err != nil || !bytes.Equal(data, []byte("PNG")) {
+		t.Fatal(data, err)
+	}
+
+	resp := &testResp{}
+	err = route.OnUnmarshal("Echo.Say", []byte(`{"Msg":"a"}`), resp)
+	if err != nil || resp.Msg != "a" {
+		t.Fatal(resp.Msg, err)
+	}
+
+	// no default interceptor
+	route.SetDefaultInterceptor(nil)
+	_, err = route.OnMarshal("Echo.Say", &testReq{})
+	if !errors.Is(err, ErrRouteInterNotExist) {
+		t.Fatalf("err %v, want %v", err, ErrRouteInterNotExist)
+	}
+
+	err = route.OnUnmarshal("Echo.Say", nil, resp)
+	if !errors.Is(err, ErrRouteInterNotExist) {
+		t.Fatalf("err %v, want %v", err, ErrRouteInterNotExist)
+	}
+}
+
+func TestRawInterceptor(t *testing.T) {
+	raw := &RawInterceptor{}
+	src := []byte("HELLO")
+	data, err := raw.OnMarshal("Bulk.Echo", src)
+	if err != nil || !bytes.Equal(data, src) {
+		t.Fatal(data, err)
+	}
+
+	data, err = raw.OnMarshal("Bulk.Echo", &src)
+	if err != nil || !bytes.Equal(data, src) {
+		t.Fatal(data, err)
+	}
+
+	var nilBytes *[]byte
+	_, err = raw.OnMarshal("Bulk.Echo", nilBytes)
+	if !errors.Is(err, ErrRawInterNilBytes) {
+		t.Fatalf("err %v, want %v", err, ErrRawInterNilBytes)
+	}
+
+	_, err = raw.OnMarshal("Bulk.Echo", "HELLO")
+	if !errors.Is(err, ErrRawInterNotBytes) {
+		t.Fatalf("err %v, want %v", err, ErrRawInterNotBytes)
+	}
+
+	// the bytes are copied
+	dst := make([]byte, 0)
+	err = raw.OnUnmarshal("Bulk.Echo", src, &dst)
+	src[0] = 'J'
+	if err != nil || !bytes.Equal(dst, []byte("HELLO")) {
+		t.Fatalf("dst %q %v", dst, err)
+	}
+
+	err = raw.OnUnmarshal("Bulk.Echo", src, dst)
+	if !errors.Is(err, ErrRawInterNotBytes) {
+		t.Fatalf("err %v, want %v", err, ErrRawInterNotBytes)
+	}
+
+	err = raw.OnUnmarshal("Bulk.Echo", src, nilBytes)
+	if !errors.Is(err, ErrRawInterNilBytes) {
+		t.Fatalf("err %v, want %v", err, ErrRawInterNilBytes)
+	}
+}
+
+func TestRouteInterceptorCall(t *testing.T) {
+	srv, a, _ := newTestServer(t, RPC_HEADER_VER_1, &testEchoService{no: 1})
+	srvRoute := NewRouteInterceptor(&JsonInterceptor{})
+	srvRoute.SetServiceInterceptor("Bulk", &RawInterceptor{})
+	srv.SetInterceptor(srvRoute)
+	err := srv.RegisterService("Bulk", &testBulkService{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := newTestPipeline(t, RPC_HEADER_VER_1, srv, a)
+	route := NewRouteInterceptor(&JsonInterceptor{})
+	route.SetServiceInterceptor("Bulk", &RawInterceptor{})
+	p.SetInterceptor(route)
+
+	resp := &testResp{}
+	_, err = p.Call("Echo", "Say", &testReq{Msg: "a"}, resp)
+	if err != nil || resp.Msg != "1:a" {
+		t.Fatal(resp.Msg, err)
+	}
+
+	bulkResp := make([]byte, 0)
+	_, err = p.Call("Bulk", "Echo", []byte("HELLO"), &bulkResp)
+	if err != nil || !bytes.Equal(bulkResp, []byte("bulk:HELLO")) {
+		t.Fatalf("resp %q %v", bulkResp, err)
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"testing"
+)
+
+type testCodecObj struct {
+	Name  string
+	No    uint32
+	Tags  []string
+	Score map[string]int32
+}
+
+// testBulkService is registered as "Bulk", Echo answer the bytes prefixed by "bulk:".
+type testBulkService struct {
+}
+
+func (s *testBulkService) Echo(ctx context.Context, req *[]byte) (*[]byte, error) {
+	resp := append([]byte("bulk:"), (*req)...)
+	return &resp, nil
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	codecs := []Codec{&JsonInterceptor{}, &MsgpackInterceptor{}, &CborInterceptor{}}
+	src := &testCodecObj{Name: "a", No: 7, Tags: []string{"x", "y"}, Score: map[string]int32{"x": -1}}
+	for _, codec := range codecs {
+		data, err := codec.OnMarshal("Echo.Say", src)
+		if err != nil {
+			t.Fatal(codec.GetName(), err)
+		}
+
+		dst := &testCodecObj{}
+		err = codec.OnUnmarshal("Echo.Say", data, dst)
+		if err != nil || !reflect.DeepEqual(dst, src) {
+			t.Fatalf("%s: %+v %v", codec.GetName(), dst, err)
+		}
+
+		// the func list of FetchFuncList
+		funcList := &FetchFuncListResp{MapFuncName2No: map[string]uint16{"Echo.Say": 1, "Bulk.Echo": RPC_MAX_FUNC_NO}}
+		data, err = codec.OnMarshal(RPC_FUNC_NAME_FUNC_LIST, funcList)
+		if err != nil {
+			t.Fatal(codec.GetName(), err)
+		}
+
+		funcListDst := &FetchFuncListResp{}
+		err = codec.OnUnmarshal(RPC_FUNC_NAME_FUNC_LIST, data, funcListDst)
+		if err != nil || !reflect.DeepEqual(funcListDst.MapFuncName2No, funcList.MapFuncName2No) {
+			t.Fatalf("%s: %v %v", codec.GetName(), funcListDst.MapFuncName2No, err)
+		}
+	}
+}
+
+func TestNegotiateCodec(t *testing.T) {
+	srv, a, _ := newTestServer(t, RPC_HEADER_VER_2, &testEchoService{no: 1})
+	srv.AddCodec(&CborInterceptor{})
+	go srv.Start()
+	t.Cleanup(srv.Stop)
+
+	p := NewPipeline(a, TEST_SERVER_PEER_TYPE, TEST_SERVER_PEER_NO, TEST_MARK)
+	p.SetHeaderVersion(RPC_HEADER_VER_2)
+	p.SetInterceptor(&JsonInterceptor{})
+	go p.Start()
+	t.Cleanup(p.Stop)
+
+	// msgpack is not added to the server, cbor is chosen
+	err := p.NegotiateCodec(context.Background(), &MsgpackInterceptor{}, &CborInterceptor{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p.GetCodecName() != CODEC_NAME_CBOR {
+		t.Fatalf("codec %q, want %q", p.GetCodecName(), CODEC_NAME_CBOR)
+	}
+
+	resp := &testResp{}
+	_, err = p.Call("Echo", "Say", &testReq{Msg: "a"}, resp)
+	if err != nil || resp.Msg != "1:a" {
+		t.Fatal(resp.Msg, err)
+	}
+}
+
+func TestNegotiateCodecWithRoute(t *testing.T) {
+	srv, a, _ := newTestServer(t, RPC_HEADER_VER_2, &testEchoService{no: 1})
+	srvRoute := NewRouteInterceptor(&JsonInterceptor{})
+	srvRoute.SetServiceInterceptor("Bulk", &RawInterceptor{})
+	srv.SetInterceptor(srvRoute)
+	srv.AddCodec(&MsgpackInterceptor{})
+	err := srv.RegisterService("Bulk", &testBulkService{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go srv.Start()
+	t.Cleanup(srv.Stop)
+
+	route := NewRouteInterceptor(&JsonInterceptor{})
+	route.SetServiceInterceptor("Bulk", &RawInterceptor{})
+	p := NewPipeline(a, TEST_SERVER_PEER_TYPE, TEST_SERVER_PEER_NO, TEST_MARK)
+	p.SetHeaderVersion(RPC_HEADER_VER_2)
+	p.SetInterceptor(route)
+	go p.Start()
+	t.Cleanup(p.Stop)
+
+	err = p.NegotiateCodec(context.Background(), &MsgpackInterceptor{})
+	if err != nil || p.GetCodecName() != CODEC_NAME_MSGPACK {
+		t.Fatalf("codec %q %v, want %q", p.GetCodecName(), err, CODEC_NAME_MSGPACK)
+	}
+
+	// the default func use the negotiated codec
+	resp := &testResp{}
+	_, err = p.Call("Echo", "Say", &testReq{Msg: "a"}, resp)
+	if err != nil || resp.Msg != "1:a" {
+		t.Fatal(resp.Msg, err)
+	}
+
+	// the routed func keep the raw codec on both sides
+	bulkResp := make([]byte, 0)
+	_, err = p.Call("Bulk", "Echo", []byte("HELLO"), &bulkResp)
+	if err != nil || !bytes.Equal(bulkResp, []byte("bulk:HELLO")) {
+		t.Fatalf("resp %q %v", bulkResp, err)
+	}
+
+	// the codec name is not sent for the routed func
+	funcNo, ok := p.getFuncNo("Bulk.Echo")
+	if !ok {
+		t.Fatal("Bulk.Echo not fetched")
+	}
+
+	reqHeader, err := p.newRequestHeader(context.Background(), 1, funcNo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, ok = reqHeader.GetExt(RPC_EXT_CODEC)
+	if ok {
+		t.Fatal("codec name sent for the routed func")
+	}
+
+	// the server route win the codec name sent by a peer
+
+	h := NewVersionPackHeader(RPC_HEADER_VER_2, TEST_MARK, 1, funcNo)
+	h.SetExt(RPC_EXT_CODEC, []byte(CODEC_NAME_MSGPACK))
+	req := NewServerRequest(TEST_CLIENT_PEER_TYPE, TEST_CLIENT_PEER_NO, h, []byte("HELLO"))
+	err = srv.registry.SelectInterceptor(req)
+	if err != nil || req.Inter != Interceptor(srvRoute) {
+		t.Fatalf("interceptor %T %v, want the route", req.Inter, err)
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var (
+	ErrLoopbackNetClosed        = fmt.Errorf("%w: loopback net closed", ErrNetNotConnected)
+	ErrLoopbackNetPeerNotExist  = fmt.Errorf("%w: loopback peer not exist", ErrNetNotConnected)
+	ErrLoopbackNetPeerNotMatch  = errors.New("loopback peer not match")
+	ErrLoopbackNetDropRateRange = errors.New("drop rate out of range")
+)
+
+// LoopbackNet is an in-process Net, a pack written to one endpoint
+// is read from the other endpoint of the pair.
+type LoopbackNet struct {
+	*BaseNet
+	selfPeerType  uint32
+	selfPeerNo    uint32
+	peer          *LoopbackNet
+	latency       time.Duration
+	reorderWindow time.Duration
+	dropRate      float64
+	rnd           *rand.Rand
+	lckOpt        *sync.Mutex
+}
+
+func newLoopbackNet(selfPeerType uint32, selfPeerNo uint32, maxReadQue uint32) *LoopbackNet {
+	return &LoopbackNet{
+		BaseNet:       NewBaseNet(maxReadQue),
+		selfPeerType:  selfPeerType,
+		selfPeerNo:    selfPeerNo,
+		peer:          nil,
+		latency:       0,
+		reorderWindow: 0,
+		dropRate:      0,
+		rnd:           rand.New(rand.NewSource(time.Now().UnixNano())),
+		lckOpt:        &sync.Mutex{},
+	}
+}
+
+// Create a pair of connected loopback nets.
+// @param peerTypeA, the peer type of endpoint A.
+// @param peerNoA, the peer No. of endpoint A.
+// @param peerTypeB, the peer type of endpoint B.
+// @param peerNoB, the peer No. of endpoint B.
+// @param maxReadQue, the max read queue size of each endpoint.
+// @return *LoopbackNet, endpoint A.
+// @return *LoopbackNet, endpoint B.
+func NewLoopbackNetPair(peerTypeA uint32, peerNoA uint32, peerTypeB uint32, peerNoB uint32, maxReadQue uint32) (*LoopbackNet, *LoopbackNet) {
+	a := newLoopbackNet(peerTypeA, peerNoA, maxReadQue)
+	b := newLoopbackNet(peerTypeB, peerNoB, maxReadQue)
+	a.peer = b
+	b.peer = a
+	return a, b
+}
+
+// Set the delay of every pack written by this endpoint.
+func (n *LoopbackNet) SetLatency(latency time.Duration) {
+	n.lckOpt.Lock()
+	defer n.lckOpt.Unlock()
+
+	n.latency = latency
+}
+
+// Set a random extra delay in [0, window) of every pack written by this endpoint,
+// so the packs may arrive out of order.
+func (n *LoopbackNet) SetReorderWindow(window time.Duration) {
+	n.lckOpt.Lock()
+	defer n.lckOpt.Unlock()
+
+	n.reorderWindow = window
+}
+
+// Set the probability in [0, 1] to drop a pack written by this endpoint.
+func (n *LoopbackNet) SetDropRate(dropRate float64) error {
+	if dropRate < 0 || dropRate > 1 {
+		return n.ec.Throw("SetDropRate", ErrLoopbackNetDropRateRange)
+	}
+
+	n.lckOpt.Lock()
+	defer n.lckOpt.Unlock()
+
+	n.dropRate = dropRate
+	return nil
+}
+
+func (n *LoopbackNet) GetPeer() *LoopbackNet {
+	return n.peer
+}
+
+// Close both endpoints, so the reads of the peer fail too.
+func (n *LoopbackNet) Close() {
+	n.BaseNet.Close()
+	if n.peer != nil {
+		n.peer.BaseNet.Close()
+	}
+}
+
+// rpc.Net
+func (n *LoopbackNet) WriteRpcPack(dstPeerType uint32, dstPeerNo uint32, payload ...[]byte) error {
+	if n.IsClosed() {
+		return n.ec.Throw("WriteRpcPack", ErrLoopbackNetClosed)
+	}
+
+	if n.peer == nil || n.peer.IsClosed() {
+		return n.ec.Throw("WriteRpcPack", ErrLoopbackNetPeerNotExist)
+	}
+
+	if dstPeerType != n.peer.selfPeerType || dstPeerNo != n.peer.selfPeerNo {
+		return n.ec.Throw("WriteRpcPack", ErrLoopbackNetPeerNotMatch)
+	}
+
+	packLen := 0
+	for _, frame := range payload {
+		packLen += len(frame)
+	}
+
+	data := make([]byte, 0, packLen)
+	for _, frame := range payload {
+		data = append(data, frame...)
+	}
+
+	bDrop, delay := n.getDeliverOpt()
+	if bDrop {
+		return nil
+	}
+
+	if delay == 0 {
+		n.peer.AddReadPack(n.selfPeerType, n.selfPeerNo, data)
+		return nil
+	}
+
+	time.AfterFunc(delay, func() {
+		n.peer.AddReadPack(n.selfPeerType, n.selfPeerNo, data)
+	})
+
+	return nil
+}
+
+func (n *LoopbackNet) getDeliverOpt() (bool, time.Duration) {
+	n.lckOpt.Lock()
+	defer n.lckOpt.Unlock()
+
+	if n.dropRate > 0 && n.rnd.Float64() < n.dropRate {
+		return true, 0
+	}
+
+	delay := n.latency
+	if n.reorderWindow > 0 {
+		delay += time.Duration(n.rnd.Int63n(int64(n.reorderWindow)))
+	}
+
+	return false, delay
+}
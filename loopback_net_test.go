@@ -0,0 +1,266 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// the loopback pair of the tests, the pipeline is on A and the server is on B.
+const (
+	TEST_CLIENT_PEER_TYPE = uint32(2)
+	TEST_CLIENT_PEER_NO   = uint32(7)
+	TEST_SERVER_PEER_TYPE = uint32(1)
+	TEST_SERVER_PEER_NO   = uint32(1)
+	TEST_MARK             = "YX"
+	TEST_MAX_READ_QUE     = uint32(1024)
+)
+
+type testReq struct {
+	Msg string
+}
+
+type testResp struct {
+	Msg string
+}
+
+// testEchoService is registered as "Echo", Say answer "<No.>:<Msg>".
+type testEchoService struct {
+	no    uint32
+	delay time.Duration
+	bFail int32
+	calls int32
+}
+
+func (s *testEchoService) Say(ctx context.Context, req *testReq) (*testResp, error) {
+	atomic.AddInt32(&s.calls, 1)
+	if s.delay > 0 {
+		time.Sleep(s.delay)
+	}
+
+	if atomic.LoadInt32(&s.bFail) == 1 {
+		return nil, NewRpcError(RES_CODE_UNAVAILABLE, "down")
+	}
+
+	return &testResp{Msg: fmt.Sprintf("%d:%s", s.no, req.Msg)}, nil
+}
+
+func (s *testEchoService) setFail(bFail bool) {
+	fail := int32(0)
+	if bFail {
+		fail = 1
+	}
+
+	atomic.StoreInt32(&s.bFail, fail)
+}
+
+func (s *testEchoService) getCalls() int32 {
+	return atomic.LoadInt32(&s.calls)
+}
+
+// create a server on endpoint B of a loopback pair, register the handlers before newTestPipeline.
+func newTestServer(t *testing.T, ver uint8, svc *testEchoService) (*Server, *LoopbackNet, *LoopbackNet) {
+	a, b := NewLoopbackNetPair(TEST_CLIENT_PEER_TYPE, TEST_CLIENT_PEER_NO, TEST_SERVER_PEER_TYPE, TEST_SERVER_PEER_NO, TEST_MAX_READ_QUE)
+	srv := NewServer(b, TEST_MARK)
+	srv.SetHeaderVersion(ver)
+	srv.SetInterceptor(&JsonInterceptor{})
+	if svc != nil {
+		err := srv.RegisterService("Echo", svc)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return srv, a, b
+}
+
+// start the server, then create a pipeline on endpoint A and fetch the func list.
+func newTestPipeline(t *testing.T, ver uint8, srv *Server, net Net) *Pipeline {
+	go srv.Start()
+	t.Cleanup(srv.Stop)
+
+	p := NewPipeline(net, TEST_SERVER_PEER_TYPE, TEST_SERVER_PEER_NO, TEST_MARK)
+	p.SetHeaderVersion(ver)
+	p.SetInterceptor(&JsonInterceptor{})
+	go p.Start()
+	t.Cleanup(p.Stop)
+
+	err := p.FetchFuncList()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return p
+}
+
+// add a pipeline of peerType to Client, it is removed when the test end.
+func addTestClientPipeline(t *testing.T, peerType uint32, peerNo uint32, svc *testEchoService) *Pipeline {
+	a, b := NewLoopbackNetPair(TEST_CLIENT_PEER_TYPE, TEST_CLIENT_PEER_NO, peerType, peerNo, TEST_MAX_READ_QUE)
+	srv := NewServer(b, TEST_MARK)
+	srv.SetInterceptor(&JsonInterceptor{})
+	err := srv.RegisterService("Echo", svc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go srv.Start()
+	t.Cleanup(srv.Stop)
+
+	p, err := Client.AddPipeline(a, peerType, peerNo, TEST_MARK, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		Client.RemovePipeline(peerType, peerNo)
+	})
+
+	p.SetInterceptor(&JsonInterceptor{})
+	err = p.FetchFuncList()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return p
+}
+
+// wait until cond is true or the timeout.
+func waitTestCond(timeout time.Duration, cond func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			return false
+		}
+
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	return true
+}
+
+func TestLoopbackNetPair(t *testing.T) {
+	a, b := NewLoopbackNetPair(TEST_CLIENT_PEER_TYPE, TEST_CLIENT_PEER_NO, TEST_SERVER_PEER_TYPE, TEST_SERVER_PEER_NO, TEST_MAX_READ_QUE)
+	err := a.WriteRpcPack(TEST_SERVER_PEER_TYPE, TEST_SERVER_PEER_NO, []byte("ab"), []byte("c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pack, err := b.ReadRpcPack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(pack.Payload) != "abc" {
+		t.Fatalf("payload %q, want %q", pack.Payload, "abc")
+	}
+
+	err = a.WriteRpcPack(TEST_SERVER_PEER_TYPE, TEST_SERVER_PEER_NO+1, []byte("x"))
+	if err == nil {
+		t.Fatal("write to a wrong peer should fail")
+	}
+
+	err = a.SetDropRate(1.5)
+	if err == nil {
+		t.Fatal("drop rate out of [0, 1] should fail")
+	}
+}
+
+func TestLoopbackNetClose(t *testing.T) {
+	a, b := NewLoopbackNetPair(TEST_CLIENT_PEER_TYPE, TEST_CLIENT_PEER_NO, TEST_SERVER_PEER_TYPE, TEST_SERVER_PEER_NO, TEST_MAX_READ_QUE)
+	a.Close()
+
+	_, err := b.ReadRpcPack()
+	if err == nil {
+		t.Fatal("read of the peer should fail after close")
+	}
+
+	err = b.WriteRpcPack(TEST_CLIENT_PEER_TYPE, TEST_CLIENT_PEER_NO, []byte("x"))
+	if err == nil {
+		t.Fatal("write of the peer should fail after close")
+	}
+}
+
+func TestLoopbackNetTimeout(t *testing.T) {
+	srv, a, b := newTestServer(t, RPC_HEADER_VER_1, &testEchoService{no: 1})
+	p := newTestPipeline(t, RPC_HEADER_VER_1, srv, a)
+	p.SetTimeout(1)
+	b.SetLatency(1500 * time.Millisecond)
+
+	_, err := p.Call("Echo", "Say", &testReq{}, &testResp{})
+	if !errors.Is(err, ErrPipelineCallTimeout) {
+		t.Fatalf("err %v, want %v", err, ErrPipelineCallTimeout)
+	}
+
+	if p.GetPendingCount() != 0 {
+		t.Fatalf("pending %d after the timeout", p.GetPendingCount())
+	}
+}
+
+func TestLoopbackNetReorder(t *testing.T) {
+	srv, a, b := newTestServer(t, RPC_HEADER_VER_1, &testEchoService{no: 1})
+	p := newTestPipeline(t, RPC_HEADER_VER_1, srv, a)
+	a.SetReorderWindow(20 * time.Millisecond)
+	b.SetReorderWindow(20 * time.Millisecond)
+
+	// every response match its request however the packs arrive
+	wg := &sync.WaitGroup{}
+	chanErr := make(chan error, 32)
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			msg := fmt.Sprintf("m%d", i)
+			resp := &testResp{}
+			_, err := p.Call("Echo", "Say", &testReq{Msg: msg}, resp)
+			if err == nil && resp.Msg != "1:"+msg {
+				err = fmt.Errorf("resp %q, want %q", resp.Msg, "1:"+msg)
+			}
+
+			if err != nil {
+				chanErr <- err
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	close(chanErr)
+	for err := range chanErr {
+		t.Fatal(err)
+	}
+}
+
+func TestLoopbackNetForceCallStop(t *testing.T) {
+	srv, a, b := newTestServer(t, RPC_HEADER_VER_1, &testEchoService{no: 1})
+	p := newTestPipeline(t, RPC_HEADER_VER_1, srv, a)
+	b.SetLatency(time.Second)
+
+	chanErr := make(chan error, 1)
+	go func() {
+		_, err := p.Call("Echo", "Say", &testReq{}, &testResp{})
+		chanErr <- err
+	}()
+
+	if !waitTestCond(time.Second, func() bool { return p.GetPendingCount() == 1 }) {
+		t.Fatal("call not sent")
+	}
+
+	p.Stop()
+	select {
+	case err := <-chanErr:
+		if !errors.Is(err, ErrPipelineForceCallStop) {
+			t.Fatalf("err %v, want %v", err, ErrPipelineForceCallStop)
+		}
+
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("call not stopped")
+	}
+}
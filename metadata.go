@@ -0,0 +1,226 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+var (
+	ErrMetadataTooLarge   = errors.New("metadata too large")
+	ErrMetadataDataBroken = errors.New("metadata data broken")
+	ErrMetadataNeedV2     = errors.New("metadata need header v2")
+)
+
+const (
+	RPC_MD_COUNT_LEN = 2
+	RPC_MD_STR_LEN   = 2
+	RPC_MD_MAX_STR   = 0xFFFF
+)
+
+//========================
+//       Metadata
+//========================
+type Metadata map[string]string
+
+func NewMetadata(kvs map[string]string) Metadata {
+	md := make(Metadata, len(kvs))
+	for k, v := range kvs {
+		md[k] = v
+	}
+
+	return md
+}
+
+func (md Metadata) Get(key string) (string, bool) {
+	value, ok := md[key]
+	return value, ok
+}
+
+func (md Metadata) Set(key string, value string) {
+	md[key] = value
+}
+
+func (md Metadata) Clone() Metadata {
+	return NewMetadata(md)
+}
+
+// Marshal to count(2) + [keyLen(2) + key + valueLen(2) + value] ...
+func (md Metadata) Marshal() ([]byte, error) {
+	if len(md) > RPC_MD_MAX_STR {
+		return nil, ErrMetadataTooLarge
+	}
+
+	keys := make([]string, 0, len(md))
+	for key := range md {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	buffWrap := &bytes.Buffer{}
+	binary.Write(buffWrap, binary.BigEndian, uint16(len(md)))
+	for _, key := range keys {
+		err := writeMetadataStr(buffWrap, key)
+		if err != nil {
+			return nil, err
+		}
+
+		err = writeMetadataStr(buffWrap, md[key])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return buffWrap.Bytes(), nil
+}
+
+func UnmarshalMetadata(data []byte) (Metadata, error) {
+	buffWrap := bytes.NewBuffer(data)
+	cnt := uint16(0)
+	err := binary.Read(buffWrap, binary.BigEndian, &cnt)
+	if err != nil {
+		return nil, ErrMetadataDataBroken
+	}
+
+	md := make(Metadata, cnt)
+	for i := uint16(0); i < cnt; i++ {
+		key, err := readMetadataStr(buffWrap)
+		if err != nil {
+			return nil, err
+		}
+
+		value, err := readMetadataStr(buffWrap)
+		if err != nil {
+			return nil, err
+		}
+
+		md[key] = value
+	}
+
+	return md, nil
+}
+
+func writeMetadataStr(buffWrap *bytes.Buffer, str string) error {
+	if len(str) > RPC_MD_MAX_STR {
+		return ErrMetadataTooLarge
+	}
+
+	binary.Write(buffWrap, binary.BigEndian, uint16(len(str)))
+	buffWrap.WriteString(str)
+	return nil
+}
+
+func readMetadataStr(buffWrap *bytes.Buffer) (string, error) {
+	strLen := uint16(0)
+	err := binary.Read(buffWrap, binary.BigEndian, &strLen)
+	if err != nil {
+		return "", ErrMetadataDataBroken
+	}
+
+	if buffWrap.Len() < int(strLen) {
+		return "", ErrMetadataDataBroken
+	}
+
+	return string(buffWrap.Next(int(strLen))), nil
+}
+
+// set the metadata to the header extension.
+func setHeaderMetadata(h *PackHeader, md Metadata) error {
+	if len(md) == 0 {
+		return nil
+	}
+
+	if h.Version == RPC_HEADER_VER_1 {
+		return ErrMetadataNeedV2
+	}
+
+	data, err := md.Marshal()
+	if err != nil {
+		return err
+	}
+
+	h.SetExt(RPC_EXT_METADATA, data)
+	return nil
+}
+
+// get the metadata from the header extension.
+func getHeaderMetadata(h *PackHeader) (Metadata, error) {
+	data, ok := h.GetExt(RPC_EXT_METADATA)
+	if !ok {
+		return Metadata{}, nil
+	}
+
+	return UnmarshalMetadata(data)
+}
+
+//========================
+//       context
+//========================
+type outgoingMetadataKey struct{}
+type trailerMetadataKey struct{}
+type serverRequestKey struct{}
+
+// Attach the metadata sent with the calls made by ctx.
+func NewOutgoingContext(ctx context.Context, md Metadata) context.Context {
+	return context.WithValue(ctx, outgoingMetadataKey{}, md)
+}
+
+func FromOutgoingContext(ctx context.Context) (Metadata, bool) {
+	md, ok := ctx.Value(outgoingMetadataKey{}).(Metadata)
+	return md, ok
+}
+
+// Attach a trailer, filled with the response metadata of the call made by ctx.
+func NewTrailerContext(ctx context.Context, trailer *Metadata) context.Context {
+	return context.WithValue(ctx, trailerMetadataKey{}, trailer)
+}
+
+func fromTrailerContext(ctx context.Context) (*Metadata, bool) {
+	trailer, ok := ctx.Value(trailerMetadataKey{}).(*Metadata)
+	return trailer, ok
+}
+
+func newServerRequestContext(ctx context.Context, req *ServerRequest) context.Context {
+	return context.WithValue(ctx, serverRequestKey{}, req)
+}
+
+// Get the request being handled, in server handler.
+func FromServerRequestContext(ctx context.Context) (*ServerRequest, bool) {
+	req, ok := ctx.Value(serverRequestKey{}).(*ServerRequest)
+	return req, ok
+}
+
+// Get the request metadata, in server handler.
+func FromIncomingContext(ctx context.Context) (Metadata, bool) {
+	req, ok := FromServerRequestContext(ctx)
+	if !ok {
+		return nil, false
+	}
+
+	md, err := req.LoadMetadata()
+	if err != nil {
+		return nil, false
+	}
+
+	return md, true
+}
+
+// Set the response metadata, in server handler.
+func SetTrailer(ctx context.Context, md Metadata) bool {
+	req, ok := FromServerRequestContext(ctx)
+	if !ok {
+		return false
+	}
+
+	for k, v := range md {
+		req.Trailer[k] = v
+	}
+
+	return true
+}
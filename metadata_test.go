@@ -0,0 +1,92 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// answer the "trace" metadata, and set the "srv" trailer.
+func registerTestMetaFunc(t *testing.T, srv *Server) {
+	_, err := srv.Register("Meta", "Who", func(ctx context.Context, req *ServerRequest) (int32, []byte, error) {
+		md, _ := FromIncomingContext(ctx)
+		trace, _ := md.Get("trace")
+		SetTrailer(ctx, NewMetadata(map[string]string{"srv": "ok"}))
+		return RES_CODE_SUCC, []byte(`{"Msg":"` + trace + `"}`), nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMetadataMarshal(t *testing.T) {
+	md := NewMetadata(map[string]string{"a": "1", "b": "", "": "c"})
+	data, err := md.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	md2, err := UnmarshalMetadata(data)
+	if err != nil || len(md2) != len(md) {
+		t.Fatalf("unmarshal %v %v, want %v", md2, err, md)
+	}
+
+	for k, v := range md {
+		v2, ok := md2.Get(k)
+		if !ok || v2 != v {
+			t.Fatalf("key %q: %q, want %q", k, v2, v)
+		}
+	}
+
+	_, err = UnmarshalMetadata(data[:len(data)-1])
+	if !errors.Is(err, ErrMetadataDataBroken) {
+		t.Fatalf("broken data: %v", err)
+	}
+}
+
+func TestMetadataTrailer(t *testing.T) {
+	srv, a, _ := newTestServer(t, RPC_HEADER_VER_2, nil)
+	registerTestMetaFunc(t, srv)
+	p := newTestPipeline(t, RPC_HEADER_VER_2, srv, a)
+
+	trailer := Metadata{}
+	ctx := NewOutgoingContext(context.Background(), NewMetadata(map[string]string{"trace": "t1"}))
+	ctx = NewTrailerContext(ctx, &trailer)
+	resp := &testResp{}
+	_, err := p.CallContext(ctx, "Meta", "Who", &testReq{}, resp)
+	if err != nil || resp.Msg != "t1" {
+		t.Fatalf("resp %q %v, want %q", resp.Msg, err, "t1")
+	}
+
+	srvTrailer, _ := trailer.Get("srv")
+	if srvTrailer != "ok" {
+		t.Fatalf("trailer %v", trailer)
+	}
+}
+
+func TestMetadataV1(t *testing.T) {
+	srv, a, _ := newTestServer(t, RPC_HEADER_VER_1, nil)
+	registerTestMetaFunc(t, srv)
+	p := newTestPipeline(t, RPC_HEADER_VER_2, srv, a)
+
+	// the metadata can not be sent by v1
+	ctx := NewOutgoingContext(context.Background(), NewMetadata(map[string]string{"trace": "t1"}))
+	_, err := p.CallContext(ctx, "Meta", "Who", &testReq{}, &testResp{})
+	if !errors.Is(err, ErrMetadataNeedV2) {
+		t.Fatalf("metadata by v1: %v", err)
+	}
+
+	// the trailer is dropped, the response is still answered
+	trailer := Metadata{}
+	ctx = NewTrailerContext(context.Background(), &trailer)
+	resp := &testResp{}
+	_, err = p.CallContext(ctx, "Meta", "Who", &testReq{}, resp)
+	if err != nil || resp.Msg != "" || len(trailer) != 0 {
+		t.Fatalf("resp %q %v, trailer %v", resp.Msg, err, trailer)
+	}
+}
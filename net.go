@@ -6,12 +6,16 @@ package rpc
 
 import (
 	"errors"
+	"sync"
 
 	"github.com/yxlib/yx"
 )
 
 var (
 	ErrNetReadChanClose = errors.New("read channel closed")
+	// wrapped by the errors of WriteRpcPack returned before writing any byte,
+	// the calls failed with it are not sent and can be retried
+	ErrNetNotConnected = errors.New("net not connected")
 )
 
 type ByteArray = []byte
@@ -46,6 +50,14 @@ type Net interface {
 	Close()
 }
 
+// PeerConnectNotifier is implemented by a Net which know the connections of the peers.
+// The server reset the header version of a peer to v1 when it connect again,
+// with the other nets the server call RemovePeer before a peer reconnect.
+type PeerConnectNotifier interface {
+	// Set the callback called when a peer is connected, before its packs are read.
+	SetPeerConnectCallback(cb func(peerType uint32, peerNo uint32))
+}
+
 //========================
 //        BaseNet
 //========================
@@ -55,6 +67,8 @@ type BaseNet struct {
 	srcPeerType uint32
 	srcPeerNo   uint32
 	chanPacks   chan *NetDataWrap
+	chanClose   chan struct{}
+	closeOnce   *sync.Once
 	logger      *yx.Logger
 	ec          *yx.ErrCatcher
 }
@@ -66,6 +80,8 @@ func NewBaseNet(maxReadQue uint32) *BaseNet {
 		srcPeerType: 0,
 		srcPeerNo:   0,
 		chanPacks:   make(chan *NetDataWrap, maxReadQue),
+		chanClose:   make(chan struct{}),
+		closeOnce:   &sync.Once{},
 		logger:      yx.NewLogger("RpcNet"),
 		ec:          yx.NewErrCatcher("RpcNet"),
 	}
@@ -109,16 +125,19 @@ func (n *BaseNet) GetPeerTypeAndNo() (uint32, uint32) {
 
 func (n *BaseNet) AddReadPack(peerType uint32, peerNo uint32, payload []byte) {
 	pack := NewNetDataWrap(peerType, peerNo, payload)
-	n.chanPacks <- pack
+	select {
+	case n.chanPacks <- pack:
+	case <-n.chanClose:
+	}
 }
 
 func (n *BaseNet) ReadRpcPack() (*NetDataWrap, error) {
-	pack, ok := <-n.chanPacks
-	if !ok {
+	select {
+	case pack := <-n.chanPacks:
+		return pack, nil
+	case <-n.chanClose:
 		return nil, n.ec.Throw("ReadRpcPack", ErrNetReadChanClose)
 	}
-
-	return pack, nil
 }
 
 func (n *BaseNet) WriteRpcPack(dstPeerType uint32, dstPeerNo uint32, payload ...[]byte) error {
@@ -126,5 +145,16 @@ func (n *BaseNet) WriteRpcPack(dstPeerType uint32, dstPeerNo uint32, payload ...
 }
 
 func (n *BaseNet) Close() {
-	close(n.chanPacks)
+	n.closeOnce.Do(func() {
+		close(n.chanClose)
+	})
+}
+
+func (n *BaseNet) IsClosed() bool {
+	select {
+	case <-n.chanClose:
+		return true
+	default:
+		return false
+	}
 }
@@ -8,6 +8,8 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"sort"
+	"sync"
 
 	"github.com/yxlib/yx"
 )
@@ -16,40 +18,188 @@ var (
 	ErrPackFrameIsNil      = errors.New("frame is nil")
 	ErrPackMarkCheckFailed = errors.New("rpc mark check failed")
 	ErrPackTooSmall        = errors.New("pack header data not enough")
+	ErrPackVerNotSupport   = errors.New("pack header version not support")
+	ErrPackSerialNoTooBig  = errors.New("serial No. out of range")
+	ErrPackV1NotSupportExt = errors.New("header v1 not support flags and extensions")
+	ErrPackExtTooLarge     = errors.New("header extension too large")
+	ErrPackExtDuplicate    = errors.New("header extension type duplicated")
 )
 
 const (
-	RPC_SERIAL_NO_LEN = 2
-	RPC_FUNC_NO_LEN   = 2
-	RPC_CODE_LEN      = 4
+	RPC_VERSION_LEN      = 1
+	RPC_FLAGS_LEN        = 1
+	RPC_SERIAL_NO_LEN    = 2
+	RPC_SERIAL_NO_V2_LEN = 4
+	RPC_FUNC_NO_LEN      = 2
+	RPC_CODE_LEN         = 4
+	RPC_EXT_AREA_LEN     = 2
+	RPC_EXT_TYPE_LEN     = 1
+	RPC_EXT_VALUE_LEN    = 2
+	RPC_MAX_EXT_AREA     = 0xFFFF
 )
 
+// header version, the reader must know the version of the peer,
+// it is agreed by FetchFuncList, see RES_CODE_HEADER_VER.
 const (
-	RES_CODE_SUCC    int32 = 0
-	RES_CODE_SYS_ERR int32 = 1
+	// mark + serialNo(2) + funcNo + code, no version byte on wire
+	RPC_HEADER_VER_1 uint8 = 1
+	// mark + version + flags + serialNo(4) + funcNo + code + extLen(2) + exts
+	// each ext is type(1) + len(2) + value
+	RPC_HEADER_VER_2 uint8 = 2
+)
+
+func IsHeaderVersionSupported(version uint8) bool {
+	return version == RPC_HEADER_VER_1 || version == RPC_HEADER_VER_2
+}
+
+// header flags, v2 only
+const (
+	RPC_FLAG_COMPRESSED  uint8 = 1 << 0
+	RPC_FLAG_STREAM      uint8 = 1 << 1
+	RPC_FLAG_ONE_WAY     uint8 = 1 << 2
+	RPC_FLAG_ERR_PAYLOAD uint8 = 1 << 3
+	RPC_FLAG_END_STREAM  uint8 = 1 << 4
+	// the payload is the credits returned to the stream sender
+	RPC_FLAG_WINDOW_UPDATE uint8 = 1 << 5
+	// a message of an opened stream, the open pack has only RPC_FLAG_STREAM
+	RPC_FLAG_STREAM_MSG uint8 = 1 << 6
+)
+
+// header extension types, v2 only
+const (
+	RPC_EXT_METADATA uint8 = 1
+	// the codec name of the call, or the negotiated codec name in FetchFuncList response
+	RPC_EXT_CODEC uint8 = 2
+	// the codec names offered in FetchFuncList request, separated by ","
+	RPC_EXT_CODEC_LIST uint8 = 3
+	// the compress type (1 byte), the payload is compressed if RPC_FLAG_COMPRESSED is set.
+	// in request it is also the type the response may use
+	RPC_EXT_COMPRESS uint8 = 4
+)
+
+const (
+	RPC_MAX_SERIAL_NO_V1 = uint32(0xFFFF)
+	RPC_MAX_SERIAL_NO_V2 = uint32(0xFFFFFFFF)
+)
+
+func GetMaxSerialNo(version uint8) uint32 {
+	if version == RPC_HEADER_VER_1 {
+		return RPC_MAX_SERIAL_NO_V1
+	}
+
+	return RPC_MAX_SERIAL_NO_V2
+}
+
+const (
+	RES_CODE_SUCC               int32 = 0
+	RES_CODE_SYS_ERR            int32 = 1
+	RES_CODE_NOT_FOUND          int32 = 2
+	RES_CODE_TIMEOUT            int32 = 3
+	RES_CODE_CANCELLED          int32 = 4
+	RES_CODE_UNAVAILABLE        int32 = 5
+	RES_CODE_INVALID_ARGUMENT   int32 = 6
+	RES_CODE_PERMISSION_DENIED  int32 = 7
+	RES_CODE_RESOURCE_EXHAUSTED int32 = 8
 )
 
 type PackHeader struct {
+	Version  uint8
 	Mark     string
+	Flags    uint8
 	SerialNo uint16
 	FuncNo   uint16
 	Code     int32
+	Exts     map[uint8][]byte
+	// the 32-bit serial No. of v2, SerialNo keep its low 16 bits.
+	// use GetSerialNo and SetSerialNo for both versions
+	LongSerialNo uint32
 
 	ec *yx.ErrCatcher
 }
 
 func NewPackHeader(mark string, serialNo uint16, funcNo uint16) *PackHeader {
-	return &PackHeader{
-		Mark:     mark,
-		SerialNo: serialNo,
-		FuncNo:   funcNo,
-		Code:     RES_CODE_SUCC,
-		ec:       yx.NewErrCatcher("rpc.PackHeader"),
+	return NewVersionPackHeader(RPC_HEADER_VER_1, mark, uint32(serialNo), funcNo)
+}
+
+func NewVersionPackHeader(version uint8, mark string, serialNo uint32, funcNo uint16) *PackHeader {
+	h := &PackHeader{
+		Version:      version,
+		Mark:         mark,
+		Flags:        0,
+		SerialNo:     0,
+		FuncNo:       funcNo,
+		Code:         RES_CODE_SUCC,
+		Exts:         nil,
+		LongSerialNo: 0,
+		ec:           yx.NewErrCatcher("rpc.PackHeader"),
 	}
+
+	h.SetSerialNo(serialNo)
+	return h
+}
+
+// Set the serial No., it must not be larger than GetMaxSerialNo(p.Version) to marshal.
+func (p *PackHeader) SetSerialNo(serialNo uint32) {
+	p.SerialNo = uint16(serialNo)
+	p.LongSerialNo = serialNo
+}
+
+func (p *PackHeader) GetSerialNo() uint32 {
+	if p.Version == RPC_HEADER_VER_1 {
+		return uint32(p.SerialNo)
+	}
+
+	return p.LongSerialNo
+}
+
+func (p *PackHeader) SetFlag(flag uint8) {
+	p.Flags |= flag
+}
+
+func (p *PackHeader) ClearFlag(flag uint8) {
+	p.Flags &^= flag
+}
+
+func (p *PackHeader) HasFlag(flag uint8) bool {
+	return p.Flags&flag != 0
+}
+
+func (p *PackHeader) SetExt(extType uint8, value []byte) {
+	if p.Exts == nil {
+		p.Exts = make(map[uint8][]byte)
+	}
+
+	p.Exts[extType] = value
+}
+
+func (p *PackHeader) GetExt(extType uint8) ([]byte, bool) {
+	value, ok := p.Exts[extType]
+	return value, ok
+}
+
+func (p *PackHeader) RemoveExt(extType uint8) {
+	delete(p.Exts, extType)
 }
 
 func (p *PackHeader) GetHeaderLen() int {
-	return len([]byte(p.Mark)) + RPC_SERIAL_NO_LEN + RPC_FUNC_NO_LEN + RPC_CODE_LEN
+	if p.Version == RPC_HEADER_VER_1 {
+		return len([]byte(p.Mark)) + RPC_SERIAL_NO_LEN + RPC_FUNC_NO_LEN + RPC_CODE_LEN
+	}
+
+	return p.getFixedHeaderLen() + p.getExtAreaLen()
+}
+
+func (p *PackHeader) getFixedHeaderLen() int {
+	return len([]byte(p.Mark)) + RPC_VERSION_LEN + RPC_FLAGS_LEN + RPC_SERIAL_NO_V2_LEN + RPC_FUNC_NO_LEN + RPC_CODE_LEN + RPC_EXT_AREA_LEN
+}
+
+func (p *PackHeader) getExtAreaLen() int {
+	extAreaLen := 0
+	for _, value := range p.Exts {
+		extAreaLen += RPC_EXT_TYPE_LEN + RPC_EXT_VALUE_LEN + len(value)
+	}
+
+	return extAreaLen
 }
 
 func (p *PackHeader) Marshal() ([]byte, error) {
@@ -72,8 +222,30 @@ func (p *PackHeader) Marshal() ([]byte, error) {
 	// tmpBuff := make([]byte, 0, RPC_SERIAL_NO_LEN+RPC_FUNC_NO_LEN)
 	// buffWrap := bytes.NewBuffer(tmpBuff)
 
-	// serial No.
-	err = binary.Write(buffWrap, binary.BigEndian, p.SerialNo)
+	// version and serial No.
+	switch p.Version {
+	case RPC_HEADER_VER_1:
+		if uint32(p.SerialNo) > RPC_MAX_SERIAL_NO_V1 || p.LongSerialNo > RPC_MAX_SERIAL_NO_V1 {
+			err = ErrPackSerialNoTooBig
+			return nil, err
+		}
+
+		if p.Flags != 0 || len(p.Exts) > 0 {
+			err = ErrPackV1NotSupportExt
+			return nil, err
+		}
+
+		err = binary.Write(buffWrap, binary.BigEndian, p.SerialNo)
+
+	case RPC_HEADER_VER_2:
+		buffWrap.WriteByte(p.Version)
+		buffWrap.WriteByte(p.Flags)
+		err = binary.Write(buffWrap, binary.BigEndian, p.LongSerialNo)
+
+	default:
+		err = ErrPackVerNotSupport
+	}
+
 	if err != nil {
 		return nil, err
 	}
@@ -90,6 +262,14 @@ func (p *PackHeader) Marshal() ([]byte, error) {
 		return nil, err
 	}
 
+	// extensions
+	if p.Version != RPC_HEADER_VER_1 {
+		err = p.marshalExts(buffWrap)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return buffWrap.Bytes(), nil
 
 	// offset := len(p.Mark)
@@ -115,8 +295,16 @@ func (p *PackHeader) Unmarshal(buff []byte) error {
 		return err
 	}
 
+	// the version is set by the caller, v1 has no version byte to check
+	if !IsHeaderVersionSupported(p.Version) {
+		err = ErrPackVerNotSupport
+		return err
+	}
+
 	// markLen := len([]byte(p.Mark))
 	// if len(buff) < markLen+RPC_SERIAL_NO_LEN+RPC_FUNC_NO_LEN {
+	p.Flags = 0
+	p.Exts = nil
 	if len(buff) < p.GetHeaderLen() {
 		err = ErrPackTooSmall
 		return err
@@ -125,8 +313,29 @@ func (p *PackHeader) Unmarshal(buff []byte) error {
 	offset := len([]byte(p.Mark))
 	buffWrap := bytes.NewBuffer(buff[offset:])
 
-	// serial No.
-	err = binary.Read(buffWrap, binary.BigEndian, &p.SerialNo)
+	// version and serial No.
+	switch p.Version {
+	case RPC_HEADER_VER_1:
+		serialNo := uint16(0)
+		err = binary.Read(buffWrap, binary.BigEndian, &serialNo)
+		p.SetSerialNo(uint32(serialNo))
+
+	case RPC_HEADER_VER_2:
+		version, _ := buffWrap.ReadByte()
+		if version != p.Version {
+			err = ErrPackVerNotSupport
+			return err
+		}
+
+		p.Flags, _ = buffWrap.ReadByte()
+		serialNo := uint32(0)
+		err = binary.Read(buffWrap, binary.BigEndian, &serialNo)
+		p.SetSerialNo(serialNo)
+
+	default:
+		err = ErrPackVerNotSupport
+	}
+
 	if err != nil {
 		return err
 	}
@@ -143,6 +352,14 @@ func (p *PackHeader) Unmarshal(buff []byte) error {
 		return err
 	}
 
+	// extensions
+	if p.Version != RPC_HEADER_VER_1 {
+		err = p.unmarshalExts(buffWrap)
+		if err != nil {
+			return err
+		}
+	}
+
 	// ====== payload
 	// offset += RPC_SERIAL_NO_LEN + RPC_FUNC_NO_LEN
 	// if len(buff) > offset {
@@ -152,6 +369,76 @@ func (p *PackHeader) Unmarshal(buff []byte) error {
 	return nil
 }
 
+func (p *PackHeader) marshalExts(buffWrap *bytes.Buffer) error {
+	extAreaLen := p.getExtAreaLen()
+	if extAreaLen > RPC_MAX_EXT_AREA {
+		return ErrPackExtTooLarge
+	}
+
+	err := binary.Write(buffWrap, binary.BigEndian, uint16(extAreaLen))
+	if err != nil {
+		return err
+	}
+
+	// sort by type, so the same header always marshal to the same bytes
+	extTypes := make([]int, 0, len(p.Exts))
+	for extType := range p.Exts {
+		extTypes = append(extTypes, int(extType))
+	}
+
+	sort.Ints(extTypes)
+	for _, extType := range extTypes {
+		value := p.Exts[uint8(extType)]
+		buffWrap.WriteByte(uint8(extType))
+		err = binary.Write(buffWrap, binary.BigEndian, uint16(len(value)))
+		if err != nil {
+			return err
+		}
+
+		buffWrap.Write(value)
+	}
+
+	return nil
+}
+
+func (p *PackHeader) unmarshalExts(buffWrap *bytes.Buffer) error {
+	extAreaLen := uint16(0)
+	err := binary.Read(buffWrap, binary.BigEndian, &extAreaLen)
+	if err != nil {
+		return err
+	}
+
+	if buffWrap.Len() < int(extAreaLen) {
+		return ErrPackTooSmall
+	}
+
+	extArea := bytes.NewBuffer(buffWrap.Next(int(extAreaLen)))
+	for extArea.Len() > 0 {
+		extType, _ := extArea.ReadByte()
+		valueLen := uint16(0)
+		err = binary.Read(extArea, binary.BigEndian, &valueLen)
+		if err != nil {
+			return ErrPackTooSmall
+		}
+
+		if extArea.Len() < int(valueLen) {
+			return ErrPackTooSmall
+		}
+
+		// the payload offset is computed from Exts, a duplicated type would break it
+		_, ok := p.Exts[extType]
+		if ok {
+			return ErrPackExtDuplicate
+		}
+
+		value := make([]byte, valueLen)
+		copy(value, extArea.Next(int(valueLen)))
+		p.SetExt(extType, value)
+	}
+
+	return nil
+}
+
 //========================
 //       Pack
 //========================
@@ -203,17 +490,23 @@ func (p *Pack) AddFrames(frames ...[]byte) error {
 //========================
 type Request struct {
 	*Pack
+	respHeader  *PackHeader
 	respCode    int32
 	respPayload []byte
 	evt         *yx.Event
+	errCancel   error
+	lckCancel   *sync.Mutex
 }
 
 func NewRequest(h *PackHeader) *Request {
 	return &Request{
 		Pack:        NewPack(h),
+		respHeader:  nil,
 		respCode:    RES_CODE_SUCC,
 		respPayload: nil,
 		evt:         yx.NewEvent(),
+		errCancel:   nil,
+		lckCancel:   &sync.Mutex{},
 	}
 }
 
@@ -241,6 +534,14 @@ func (r *Request) SetResponse(code int32, payload []byte) {
 	r.respPayload = payload
 }
 
+func (r *Request) SetResponseHeader(h *PackHeader) {
+	r.respHeader = h
+}
+
+func (r *Request) GetResponseHeader() *PackHeader {
+	return r.respHeader
+}
+
 func (r *Request) GetResponse() (int32, []byte) {
 	return r.respCode, r.respPayload
 }
@@ -258,6 +559,22 @@ func (r *Request) Cancel() {
 	r.evt.Close()
 }
 
+// Cancel with a reason, the waiting call return the reason.
+func (r *Request) CancelWithError(err error) {
+	r.lckCancel.Lock()
+	r.errCancel = err
+	r.lckCancel.Unlock()
+
+	r.evt.Close()
+}
+
+func (r *Request) GetCancelError() error {
+	r.lckCancel.Lock()
+	defer r.lckCancel.Unlock()
+
+	return r.errCancel
+}
+
 //========================
 //       Response
 //========================
@@ -289,6 +606,23 @@ func NewResponse(h *PackHeader) *Response {
 const RPC_FUNC_NO_FUNC_LIST = uint16(1)
 const RPC_FUNC_NAME_FUNC_LIST = "FetchFuncList"
 
+// The header version agreement, by the first FetchFuncList of a connection.
+// The client send it by v1 with its max version as the payload (1 byte), the old servers ignore it.
+// A server agree a version after v1 answer by v1 with RES_CODE_HEADER_VER and the version (1 byte),
+// the packs after it use the agreed version, then the client fetch the func list again.
+// The others answer the func list, and v1 is used.
+const (
+	RES_CODE_HEADER_VER      int32 = 0x7FFFFFFF
+	RPC_HEADER_VER_OFFER_LEN       = 1
+)
+
+// ping / pong, answered by every server without the middlewares
+const RPC_FUNC_NO_HEARTBEAT = uint16(0xFFFF)
+
+func IsReservedFuncNo(funcNo uint16) bool {
+	return funcNo == 0 || funcNo == RPC_FUNC_NO_FUNC_LIST || funcNo == RPC_FUNC_NO_HEARTBEAT
+}
+
 type FetchFuncListResp struct {
-	MapFuncName2No map[string]uint16 `json:"func_mapper"`
+	MapFuncName2No map[string]uint16 `json:"func_mapper" msgpack:"func_mapper" cbor:"func_mapper"`
 }
@@ -0,0 +1,234 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestPackHeaderV1(t *testing.T) {
+	h := NewPackHeader(TEST_MARK, 0x1234, 5)
+	h.Code = RES_CODE_NOT_FOUND
+	data, err := h.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(data) != h.GetHeaderLen() {
+		t.Fatalf("header len %d, want %d", len(data), h.GetHeaderLen())
+	}
+
+	h2 := NewPackHeader(TEST_MARK, 0, 0)
+	err = h2.Unmarshal(append(data, 'P'))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if h2.Version != RPC_HEADER_VER_1 || h2.GetSerialNo() != 0x1234 || h2.SerialNo != 0x1234 ||
+		h2.FuncNo != 5 || h2.Code != RES_CODE_NOT_FOUND || h2.GetHeaderLen() != len(data) {
+		t.Fatalf("unmarshal %+v", h2)
+	}
+
+	h.SetFlag(RPC_FLAG_STREAM)
+	_, err = h.Marshal()
+	if !errors.Is(err, ErrPackV1NotSupportExt) {
+		t.Fatalf("v1 with flags: %v", err)
+	}
+}
+
+func TestPackHeaderV2(t *testing.T) {
+	h := NewVersionPackHeader(RPC_HEADER_VER_2, TEST_MARK, 99999, 5)
+	h.SetFlag(RPC_FLAG_STREAM)
+	h.Code = -3
+	h.SetExt(RPC_EXT_CODEC_LIST, []byte("cbor,json"))
+	h.SetExt(RPC_EXT_METADATA, []byte{})
+	data, err := h.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h2 := NewVersionPackHeader(RPC_HEADER_VER_2, TEST_MARK, 0, 0)
+	err = h2.Unmarshal(append(data, 'P'))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if h2.Version != RPC_HEADER_VER_2 || h2.GetSerialNo() != 99999 || h2.FuncNo != 5 || h2.Code != -3 ||
+		!h2.HasFlag(RPC_FLAG_STREAM) || len(h2.Exts) != 2 || string(h2.Exts[RPC_EXT_CODEC_LIST]) != "cbor,json" {
+		t.Fatalf("unmarshal %+v", h2)
+	}
+
+	if h2.GetHeaderLen() != len(data) {
+		t.Fatalf("header len %d, want %d", h2.GetHeaderLen(), len(data))
+	}
+
+	// the 32-bit serial No. can not be sent by v1
+	h.Version = RPC_HEADER_VER_1
+	h.Flags = 0
+	h.Exts = nil
+	_, err = h.Marshal()
+	if !errors.Is(err, ErrPackSerialNoTooBig) {
+		t.Fatalf("v1 with 32-bit serial No.: %v", err)
+	}
+}
+
+func TestPackHeaderBaselineV1(t *testing.T) {
+	// the v1 layout before the version was added: mark + serialNo(2) + funcNo + code
+	for _, sno := range []uint16{0xFF00, 0xFF02, 0xFFFF} {
+		data := []byte(TEST_MARK)
+		data = append(data, byte(sno>>8), byte(sno), 0, 7, 0, 0, 0, 2, 'P')
+
+		h := NewPackHeader(TEST_MARK, 0, 0)
+		err := h.Unmarshal(data)
+		if err != nil {
+			t.Fatalf("serial No. %#x: %v", sno, err)
+		}
+
+		if h.Version != RPC_HEADER_VER_1 || h.GetSerialNo() != uint32(sno) || h.FuncNo != 7 ||
+			h.Code != RES_CODE_NOT_FOUND || h.GetHeaderLen() != len(data)-1 {
+			t.Fatalf("serial No. %#x: unmarshal %+v", sno, h)
+		}
+
+		h2 := NewPackHeader(TEST_MARK, sno, 7)
+		h2.Code = RES_CODE_NOT_FOUND
+		data2, err := h2.Marshal()
+		if err != nil || !bytes.Equal(data2, data[:len(data)-1]) {
+			t.Fatalf("serial No. %#x: marshal %v %v", sno, data2, err)
+		}
+	}
+}
+
+func TestPackHeaderVersionNotSupport(t *testing.T) {
+	data, err := NewVersionPackHeader(RPC_HEADER_VER_2, TEST_MARK, 1, 1).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ver := range []uint8{0, 3} {
+		_, err = NewVersionPackHeader(ver, TEST_MARK, 1, 1).Marshal()
+		if !errors.Is(err, ErrPackVerNotSupport) {
+			t.Fatalf("marshal version %d: %v", ver, err)
+		}
+
+		err = NewVersionPackHeader(ver, TEST_MARK, 0, 0).Unmarshal(data)
+		if !errors.Is(err, ErrPackVerNotSupport) {
+			t.Fatalf("unmarshal version %d: %v", ver, err)
+		}
+	}
+
+	// the version byte of v2 is checked
+	data[len(TEST_MARK)] = 3
+	err = NewVersionPackHeader(RPC_HEADER_VER_2, TEST_MARK, 0, 0).Unmarshal(data)
+	if !errors.Is(err, ErrPackVerNotSupport) {
+		t.Fatalf("unmarshal version byte 3: %v", err)
+	}
+}
+
+func TestPackHeaderVersionAgreement(t *testing.T) {
+	server, err := ListenTCPNet("127.0.0.1:0", TEST_SERVER_PEER_TYPE, TEST_SERVER_PEER_NO, TEST_MAX_READ_QUE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := NewServer(server, TEST_MARK)
+	srv.SetHeaderVersion(RPC_HEADER_VER_2)
+	srv.SetInterceptor(&JsonInterceptor{})
+	err = srv.RegisterService("Echo", &testEchoService{no: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go srv.Start()
+	t.Cleanup(srv.Stop)
+
+	// a v1 client, a v2 client and a client of the baseline layout, on one server.
+	// the v2 client connect again, the version is agreed again on the new connection
+	clients := []struct {
+		peerNo uint32
+		ver    uint8
+	}{{1, RPC_HEADER_VER_1}, {2, RPC_HEADER_VER_2}, {2, RPC_HEADER_VER_2}}
+
+	for _, c := range clients {
+		peerNo, ver := c.peerNo, c.ver
+		client, err := DialTCPNet(server.Addr().String(), TEST_CLIENT_PEER_TYPE, peerNo, TEST_MAX_READ_QUE)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p := NewPipeline(client, TEST_SERVER_PEER_TYPE, TEST_SERVER_PEER_NO, TEST_MARK)
+		p.SetHeaderVersion(ver)
+		p.SetInterceptor(&JsonInterceptor{})
+		p.SetTimeout(2)
+		go p.Start()
+		t.Cleanup(p.Stop)
+
+		err = p.FetchFuncList()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if p.GetAgreedHeaderVersion() != ver || srv.getOrAddPeer(TEST_CLIENT_PEER_TYPE, peerNo).GetHeaderVersion() != ver {
+			t.Fatalf("version %d: agreed %d", ver, p.GetAgreedHeaderVersion())
+		}
+
+		// the v1 serial No. can use all the 16 bits
+		p.maxSerialNo = 0xFF00 - 1
+		for i := 0; i < 2; i++ {
+			resp := &testResp{}
+			_, err = p.Call("Echo", "Say", &testReq{Msg: "x"}, resp)
+			if err != nil || resp.Msg != "1:x" {
+				t.Fatalf("version %d: %v %q", ver, err, resp.Msg)
+			}
+		}
+	}
+
+	baseline, err := DialTCPNet(server.Addr().String(), TEST_CLIENT_PEER_TYPE, 9, TEST_MAX_READ_QUE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(baseline.Close)
+
+	// a FetchFuncList without payload, then a heartbeat
+	for _, funcNo := range []uint16{RPC_FUNC_NO_FUNC_LIST, RPC_FUNC_NO_HEARTBEAT} {
+		data := []byte(TEST_MARK)
+		data = append(data, 0xFF, 0x01, byte(funcNo>>8), byte(funcNo), 0, 0, 0, 0)
+		err = baseline.WriteRpcPack(TEST_SERVER_PEER_TYPE, TEST_SERVER_PEER_NO, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pack, err := baseline.ReadRpcPack()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		h := NewPackHeader(TEST_MARK, 0, 0)
+		err = h.Unmarshal(pack.Payload)
+		if err != nil || h.GetSerialNo() != 0xFF01 || h.FuncNo != funcNo || h.Code != RES_CODE_SUCC {
+			t.Fatalf("baseline func %d: %+v %v", funcNo, h, err)
+		}
+	}
+}
+
+func TestPackHeaderExtDuplicate(t *testing.T) {
+	data, err := NewVersionPackHeader(RPC_HEADER_VER_2, TEST_MARK, 1, 1).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// replace the empty ext area with two exts of the same type
+	exts := []byte{9, 0, 1, 'a', 9, 0, 1, 'b'}
+	buff := bytes.NewBuffer(data[:len(data)-RPC_EXT_AREA_LEN])
+	buff.Write([]byte{0, byte(len(exts))})
+	buff.Write(exts)
+
+	err = NewVersionPackHeader(RPC_HEADER_VER_2, TEST_MARK, 0, 0).Unmarshal(buff.Bytes())
+	if !errors.Is(err, ErrPackExtDuplicate) {
+		t.Fatalf("duplicated ext: %v", err)
+	}
+}
@@ -5,8 +5,12 @@
 package rpc
 
 import (
+	"context"
 	"errors"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/yxlib/yx"
 )
@@ -16,6 +20,11 @@ var (
 	ErrPipelineInterNil       = errors.New("interceptor is nil")
 	ErrPipelineNetNil         = errors.New("rpc net is nil")
 	ErrPipelineForceCallStop  = errors.New("force call stop")
+	ErrPipelineTooManyReqs    = errors.New("too many in-flight requests")
+	ErrPipelineCallTimeout    = errors.New("call timeout")
+	ErrPipelineCodecNeedV2    = errors.New("codec negotiation need header v2")
+	ErrPipelineCodecNotExist  = errors.New("negotiated codec not exist")
+	ErrPipelineTransportLost  = errors.New("transport lost")
 )
 
 // type PipelineInterceptor interface {
@@ -29,12 +38,49 @@ type Pipeline struct {
 	peerType       uint32
 	peerNo         uint32
 	mapFuncName2No map[string]uint16
+	mapFuncNo2Name map[uint16]string
+	lckFuncs       *sync.RWMutex
 	timeoutSec     uint32
 	inter          Interceptor
-
-	maxSerialNo uint16
-	mapSno2Req  map[uint16]*Request
-	lckRequests *sync.Mutex
+	codecs         []Codec
+	codecName      string
+	lckInter       *sync.RWMutex
+	fetched        int32
+	headerVer      uint8
+	wireVer        int32
+	lckWire        *sync.RWMutex
+	middlewares    []ClientMiddleware
+	retryPolicy    *RetryPolicy
+	compressType   uint8
+	threshold      uint32
+	state          int32
+	unhealthy      int32
+	lckNet         *sync.RWMutex
+
+	netFactory NetFactory
+	minDelay   time.Duration
+	maxDelay   time.Duration
+	stateCb    PipelineStateFunc
+	chanStop   chan struct{}
+	stopOnce   *sync.Once
+
+	rtt          int64
+	chanHbStop   chan struct{}
+	lckHeartbeat *sync.Mutex
+
+	breakerCfg          *BreakerConfig
+	bFuncBreaker        bool
+	breaker             *CircuitBreaker
+	mapFuncName2Breaker map[string]*CircuitBreaker
+	lckBreakers         *sync.Mutex
+
+	maxSerialNo   uint32
+	mapSno2Req    map[uint32]*Request
+	mapSno2Stream map[uint32]*ClientStream
+	lckRequests   *sync.Mutex
+
+	mapFuncNo2PushHandler map[uint16]PushHandleFunc
+	lckPush               *sync.RWMutex
 
 	ec     *yx.ErrCatcher
 	logger *yx.Logger
@@ -47,12 +93,49 @@ func NewPipeline(net Net, peerType uint32, peerNo uint32, mark string) *Pipeline
 		peerType:       peerType,
 		peerNo:         peerNo,
 		mapFuncName2No: make(map[string]uint16),
+		mapFuncNo2Name: make(map[uint16]string),
+		lckFuncs:       &sync.RWMutex{},
 		timeoutSec:     0,
 		inter:          nil,
-
-		maxSerialNo: 0,
-		mapSno2Req:  make(map[uint16]*Request),
-		lckRequests: &sync.Mutex{},
+		codecs:         make([]Codec, 0),
+		codecName:      "",
+		lckInter:       &sync.RWMutex{},
+		fetched:        0,
+		headerVer:      RPC_HEADER_VER_1,
+		wireVer:        int32(RPC_HEADER_VER_1),
+		lckWire:        &sync.RWMutex{},
+		middlewares:    make([]ClientMiddleware, 0),
+		retryPolicy:    nil,
+		compressType:   COMPRESS_TYPE_NONE,
+		threshold:      RPC_DEFAULT_COMPRESS_THRESHOLD,
+		state:          int32(PIPELINE_STATE_CONNECTED),
+		unhealthy:      0,
+		lckNet:         &sync.RWMutex{},
+
+		netFactory: nil,
+		minDelay:   0,
+		maxDelay:   0,
+		stateCb:    nil,
+		chanStop:   make(chan struct{}),
+		stopOnce:   &sync.Once{},
+
+		rtt:          0,
+		chanHbStop:   nil,
+		lckHeartbeat: &sync.Mutex{},
+
+		breakerCfg:          nil,
+		bFuncBreaker:        false,
+		breaker:             nil,
+		mapFuncName2Breaker: make(map[string]*CircuitBreaker),
+		lckBreakers:         &sync.Mutex{},
+
+		maxSerialNo:   0,
+		mapSno2Req:    make(map[uint32]*Request),
+		mapSno2Stream: make(map[uint32]*ClientStream),
+		lckRequests:   &sync.Mutex{},
+
+		mapFuncNo2PushHandler: make(map[uint16]PushHandleFunc),
+		lckPush:               &sync.RWMutex{},
 
 		ec:     yx.NewErrCatcher("rpc.Pipeline"),
 		logger: yx.NewLogger("rpc.Pipeline"),
@@ -66,15 +149,125 @@ func (p *Pipeline) GetMark() string {
 	return p.mark
 }
 
+func (p *Pipeline) GetPeerType() uint32 {
+	return p.peerType
+}
+
+func (p *Pipeline) GetPeerNo() uint32 {
+	return p.peerNo
+}
+
+func (p *Pipeline) IsStopped() bool {
+	return p.GetState() == PIPELINE_STATE_STOPPED
+}
+
+// Mark the pipeline healthy or not, Client skip the unhealthy ones when choose by peer type.
+func (p *Pipeline) SetHealthy(bHealthy bool) {
+	unhealthy := int32(1)
+	if bHealthy {
+		unhealthy = 0
+	}
+
+	atomic.StoreInt32(&p.unhealthy, unhealthy)
+}
+
+func (p *Pipeline) IsHealthy() bool {
+	return atomic.LoadInt32(&p.unhealthy) == 0
+}
+
+// Get the count of the in-flight requests and streams.
+func (p *Pipeline) GetPendingCount() int {
+	p.lckRequests.Lock()
+	defer p.lckRequests.Unlock()
+
+	return len(p.mapSno2Req) + len(p.mapSno2Stream)
+}
+
 func (p *Pipeline) SetInterceptor(inter Interceptor) {
+	p.lckInter.Lock()
+	defer p.lckInter.Unlock()
+
 	p.inter = inter
 }
 
+// the interceptor may be replaced by the negotiation after reconnect.
+func (p *Pipeline) getInter() Interceptor {
+	p.lckInter.RLock()
+	defer p.lckInter.RUnlock()
+
+	return p.inter
+}
+
+// Get the negotiated codec name, empty if not negotiated.
+func (p *Pipeline) GetCodecName() string {
+	p.lckInter.RLock()
+	defer p.lckInter.RUnlock()
+
+	return p.codecName
+}
+
+// Add middlewares to wrap Call and CallNoReturn, the first added one is the outermost.
+// The respObj passed to the middlewares is nil for CallNoReturn.
+func (p *Pipeline) Use(middlewares ...ClientMiddleware) {
+	p.middlewares = append(p.middlewares, middlewares...)
+}
+
+// Retry the failed Call by the policy, inside the middlewares. nil to disable.
+func (p *Pipeline) SetRetryPolicy(policy *RetryPolicy) {
+	p.retryPolicy = policy
+}
+
 func (p *Pipeline) SetTimeout(timeoutSec uint32) {
 	p.timeoutSec = timeoutSec
 }
 
+// Set the max header version, it is agreed with the peer by FetchFuncList on each net,
+// the packs are v1 until then. RPC_HEADER_VER_2 widen the serial No. to 32 bits.
+func (p *Pipeline) SetHeaderVersion(version uint8) {
+	p.headerVer = version
+}
+
+func (p *Pipeline) GetHeaderVersion() uint8 {
+	return p.headerVer
+}
+
+// Get the header version agreed with the peer on the current net.
+func (p *Pipeline) GetAgreedHeaderVersion() uint8 {
+	return uint8(atomic.LoadInt32(&p.wireVer))
+}
+
+// Compress the request payload longer than threshold, header v2 only, set the header version first.
+// The peer answer with the same compress type. A call can override it by NewCompressContext.
+// The requests are not compressed if the peer agree v1 only.
+// @param compressType, the compress type, COMPRESS_TYPE_NONE to disable.
+// @param threshold, the min payload length to compress.
+// @return error, ErrCompressNeedV2 if the header version is v1,
+//         ErrCompressNotExist if the compressor is not registered.
+func (p *Pipeline) SetCompression(compressType uint8, threshold uint32) error {
+	if compressType != COMPRESS_TYPE_NONE {
+		if p.headerVer == RPC_HEADER_VER_1 {
+			return p.ec.Throw("SetCompression", ErrCompressNeedV2)
+		}
+
+		_, ok := GetCompressor(compressType)
+		if !ok {
+			return p.ec.Throw("SetCompression", ErrCompressNotExist)
+		}
+	}
+
+	p.compressType = compressType
+	p.threshold = threshold
+	return nil
+}
+
+func (p *Pipeline) GetCompression() (uint8, uint32) {
+	return p.compressType, p.threshold
+}
+
 func (p *Pipeline) GetFuncList() []string {
+	p.lckFuncs.RLock()
+	defer p.lckFuncs.RUnlock()
+
 	funcList := make([]string, 0, len(p.mapFuncName2No))
 	for name := range p.mapFuncName2No {
 		funcList = append(funcList, name)
@@ -88,34 +281,82 @@ func (p *Pipeline) Start() {
 }
 
 func (p *Pipeline) Stop() {
-	p.net.Close()
+	p.setState(PIPELINE_STATE_STOPPED, nil)
+	p.stopOnce.Do(func() {
+		close(p.chanStop)
+	})
+
+	p.getNet().Close()
 	// p.net.RemoveReadMark(p.mark, p.peerType, p.peerNo)
-	p.stopAllRequest()
+	p.stopAllRequest(ErrPipelineForceCallStop)
 }
 
 func (p *Pipeline) FetchFuncList() error {
-	if p.inter == nil {
-		return p.ec.Throw("FetchFuncList", ErrPipelineInterNil)
+	return p.FetchFuncListContext(context.Background())
+}
+
+// Negotiate the codec with the peer by FetchFuncList, header v2 only.
+// The peer choose the first codec it support, then the interceptor, or the default
+// one of a RouteInterceptor, is replaced with the chosen codec. A peer not support negotiation,
+// or agree header v1 only, answer with its default interceptor, which should be set by SetInterceptor.
+// @param ctx, the context.
+// @param codecs, the codecs in preferred order.
+// @return error, error.
+func (p *Pipeline) NegotiateCodec(ctx context.Context, codecs ...Codec) error {
+	if p.headerVer == RPC_HEADER_VER_1 {
+		return p.ec.Throw("NegotiateCodec", ErrPipelineCodecNeedV2)
 	}
 
-	code, payload, err := p.CallByFuncNo(RPC_FUNC_NO_FUNC_LIST, false)
+	p.lckInter.Lock()
+	p.codecs = codecs
+	p.lckInter.Unlock()
+
+	err := p.FetchFuncListContext(ctx)
+	return p.ec.Throw("NegotiateCodec", err)
+}
+
+func (p *Pipeline) FetchFuncListContext(ctx context.Context) error {
+	p.lckInter.RLock()
+	bNoInter := p.inter == nil && len(p.codecs) == 0
+	p.lckInter.RUnlock()
+
+	if bNoInter {
+		return p.ec.Throw("FetchFuncListContext", ErrPipelineInterNil)
+	}
+
+	code, payload, respHeader, err := p.fetchFuncList(ctx)
 	if err != nil {
-		return p.ec.Throw("FetchFuncList", err)
+		return p.ec.Throw("FetchFuncListContext", err)
 	}
 
 	if code != RES_CODE_SUCC {
-		err = errors.New(string(payload))
-		return p.ec.Throw("FetchFuncList", err)
+		err = DecodeRpcError(respHeader, payload)
+		return p.ec.Throw("FetchFuncListContext", err)
+	}
+
+	err = p.applyNegotiatedCodec(respHeader)
+	if err != nil {
+		return p.ec.Throw("FetchFuncListContext", err)
 	}
 
 	resp := &FetchFuncListResp{}
 	fullFuncName := GetFullFuncName("", RPC_FUNC_NAME_FUNC_LIST)
-	err = p.inter.OnUnmarshal(fullFuncName, payload, resp)
+	err = p.getInter().OnUnmarshal(fullFuncName, payload, resp)
 	if err != nil {
-		return p.ec.Throw("FetchFuncList", err)
+		return p.ec.Throw("FetchFuncListContext", err)
+	}
+
+	mapFuncNo2Name := make(map[uint16]string, len(resp.MapFuncName2No))
+	for name, funcNo := range resp.MapFuncName2No {
+		mapFuncNo2Name[funcNo] = name
 	}
 
+	p.lckFuncs.Lock()
 	p.mapFuncName2No = resp.MapFuncName2No
+	p.mapFuncNo2Name = mapFuncNo2Name
+	p.lckFuncs.Unlock()
+
+	atomic.StoreInt32(&p.fetched, 1)
 	return nil
 
 	// resp := &FuncListResp{}
@@ -128,8 +369,140 @@ func (p *Pipeline) FetchFuncList() error {
 	// return nil
 }
 
+// fetch the func list, the header version is offered first if not agreed on this net.
+func (p *Pipeline) fetchFuncList(ctx context.Context) (int32, []byte, *PackHeader, error) {
+	if p.headerVer != RPC_HEADER_VER_1 && p.GetAgreedHeaderVersion() == RPC_HEADER_VER_1 {
+		code, payload, respHeader, err := p.offerHeaderVersion(ctx)
+		// answered with the func list, v1 is used
+		if err != nil || code != RES_CODE_HEADER_VER {
+			return code, payload, respHeader, err
+		}
+	}
+
+	code, payload, respHeader, err := p.callByFuncNo(ctx, RPC_FUNC_NO_FUNC_LIST, false)
+	return code, payload, respHeader, err
+}
+
+// offer the max header version by a v1 FetchFuncList, see RES_CODE_HEADER_VER.
+// The other packs wait until it is answered, so the peer read them with the agreed version.
+// @param ctx, the context.
+// @return int32, RES_CODE_HEADER_VER if agreed, or the code of the func list.
+// @return []byte, the func list if not agreed.
+// @return *PackHeader, the response header.
+// @return error, error. The net is closed if the offer is sent but not answered,
+//         the peer may use the offered version already.
+func (p *Pipeline) offerHeaderVersion(ctx context.Context) (int32, []byte, *PackHeader, error) {
+	p.lckWire.Lock()
+	defer p.lckWire.Unlock()
+
+	// agreed by a concurrent FetchFuncList
+	if p.GetAgreedHeaderVersion() != RPC_HEADER_VER_1 {
+		return RES_CODE_HEADER_VER, nil, nil, nil
+	}
+
+	net := p.getNet()
+	req, err := p.sendRequest(ctx, RPC_FUNC_NO_FUNC_LIST, []byte{p.headerVer})
+	if err != nil {
+		return RES_CODE_SYS_ERR, nil, nil, err
+	}
+
+	code, payload, respHeader, err := p.waitResponse(ctx, req)
+	if err != nil {
+		net.Close()
+		return code, nil, nil, err
+	}
+
+	// the read goroutine switch the version when the answer is read
+	if code == RES_CODE_HEADER_VER && p.GetAgreedHeaderVersion() == RPC_HEADER_VER_1 {
+		net.Close()
+		return code, nil, nil, ErrPackVerNotSupport
+	}
+
+	return code, payload, respHeader, nil
+}
+
+// switch to the agreed header version when the answer of the offer is read,
+// in the read goroutine, before the next packs of the peer are read.
+func (p *Pipeline) switchHeaderVersion(h *PackHeader, payload []byte) {
+	if h.Version != RPC_HEADER_VER_1 || h.FuncNo != RPC_FUNC_NO_FUNC_LIST || h.Code != RES_CODE_HEADER_VER || len(payload) != RPC_HEADER_VER_OFFER_LEN {
+		return
+	}
+
+	version := payload[0]
+	if version <= RPC_HEADER_VER_1 || version > p.headerVer || !IsHeaderVersionSupported(version) {
+		return
+	}
+
+	// only the answer of the pending offer
+	req, ok := p.getRequest(h.GetSerialNo())
+	if !ok || req.Header.FuncNo != RPC_FUNC_NO_FUNC_LIST || req.Header.Version != RPC_HEADER_VER_1 {
+		return
+	}
+
+	atomic.StoreInt32(&p.wireVer, int32(version))
+}
+
+func (p *Pipeline) applyNegotiatedCodec(respHeader *PackHeader) error {
+	p.lckInter.Lock()
+	defer p.lckInter.Unlock()
+
+	name, ok := respHeader.GetExt(RPC_EXT_CODEC)
+	if !ok {
+		if p.inter == nil {
+			return ErrPipelineInterNil
+		}
+
+		return nil
+	}
+
+	// renegotiated after reconnect, keep the same one
+	if p.codecName == string(name) {
+		return nil
+	}
+
+	// the peer answer its default codec if none offered is supported
+	codec, ok := p.findCodec(string(name))
+	if !ok {
+		return ErrPipelineCodecNotExist
+	}
+
+	// keep the routing, change only its default codec
+	route, ok := p.inter.(*RouteInterceptor)
+	if ok {
+		route.SetDefaultInterceptor(codec)
+	} else {
+		p.inter = codec
+	}
+
+	p.codecName = codec.GetName()
+	return nil
+}
+
+// find the codec in the offered ones, or the current interceptor if it is the codec.
+// lckInter is held by the caller.
+func (p *Pipeline) findCodec(name string) (Codec, bool) {
+	for _, codec := range p.codecs {
+		if codec.GetName() == name {
+			return codec, true
+		}
+	}
+
+	inter := p.inter
+	route, ok := inter.(*RouteInterceptor)
+	if ok {
+		inter = route.GetDefaultInterceptor()
+	}
+
+	codec, ok := inter.(Codec)
+	if ok && codec.GetName() == name {
+		return codec, true
+	}
+
+	return nil, false
+}
+
 func (p *Pipeline) AsyncFetchFuncList(cb func(err error)) {
-	if p.inter == nil {
+	if p.getInter() == nil {
 		if cb != nil {
 			cb(ErrPipelineInterNil)
 		}
@@ -146,27 +519,52 @@ func (p *Pipeline) AsyncFetchFuncList(cb func(err error)) {
 }
 
 func (p *Pipeline) Call(serviceName string, funcName string, reqObj interface{}, respObj interface{}) (int32, error) {
+	return p.CallContext(context.Background(), serviceName, funcName, reqObj, respObj)
+}
+
+func (p *Pipeline) CallContext(ctx context.Context, serviceName string, funcName string, reqObj interface{}, respObj interface{}) (int32, error) {
+	invoker := p.callWithBreaker
+	if p.retryPolicy != nil {
+		invoker = p.callWithRetry
+	}
+
+	if len(p.middlewares) == 0 {
+		return invoker(ctx, serviceName, funcName, reqObj, respObj)
+	}
+
+	invoker = ChainClientMiddlewares(invoker, p.middlewares...)
+	return invoker(ctx, serviceName, funcName, reqObj, respObj)
+}
+
+func (p *Pipeline) callWithRetry(ctx context.Context, serviceName string, funcName string, reqObj interface{}, respObj interface{}) (int32, error) {
+	return p.retryPolicy.run(ctx, serviceName, funcName, func(attempt uint32) (int32, error) {
+		return p.callWithBreaker(ctx, serviceName, funcName, reqObj, respObj)
+	})
+}
+
+func (p *Pipeline) callImpl(ctx context.Context, serviceName string, funcName string, reqObj interface{}, respObj interface{}) (int32, error) {
 	code := RES_CODE_SYS_ERR
 
-	if p.inter == nil {
-		return code, p.ec.Throw("Call", ErrPipelineInterNil)
+	inter := p.getInter()
+	if inter == nil {
+		return code, p.ec.Throw("callImpl", wrapNotSent(ErrPipelineInterNil))
 	}
 
 	fullFuncName := GetFullFuncName(serviceName, funcName)
-	params, err := p.inter.OnMarshal(fullFuncName, reqObj)
+	params, err := inter.OnMarshal(fullFuncName, reqObj)
 	if err != nil {
-		return code, p.ec.Throw("Call", err)
+		return code, p.ec.Throw("callImpl", wrapNotSent(err))
 	}
 
-	code, buff, err := p.CallByFuncName(serviceName, funcName, false, params)
+	code, buff, err := p.CallByFuncNameContext(ctx, serviceName, funcName, false, params)
 	if err != nil {
-		return code, p.ec.Throw("Call", err)
+		return code, p.ec.Throw("callImpl", err)
 	}
 
 	if respObj != nil {
-		err = p.inter.OnUnmarshal(fullFuncName, buff, respObj)
+		err = inter.OnUnmarshal(fullFuncName, buff, respObj)
 		if err != nil {
-			return code, p.ec.Throw("Call", err)
+			return code, p.ec.Throw("callImpl", err)
 		}
 	}
 
@@ -174,7 +572,7 @@ func (p *Pipeline) Call(serviceName string, funcName string, reqObj interface{},
 }
 
 func (p *Pipeline) AsyncCall(cb func(code int32, resp interface{}, err error), serviceName string, funcName string, reqObj interface{}, respObj interface{}) {
-	if p.inter == nil {
+	if p.getInter() == nil {
 		if cb != nil {
 			cb(RES_CODE_SYS_ERR, respObj, ErrPipelineInterNil)
 		}
@@ -191,109 +589,365 @@ func (p *Pipeline) AsyncCall(cb func(code int32, resp interface{}, err error), s
 }
 
 func (p *Pipeline) CallNoReturn(serviceName string, funcName string, reqObj interface{}) error {
-	if p.inter == nil {
-		return p.ec.Throw("CallNoReturn", ErrPipelineInterNil)
+	return p.CallNoReturnContext(context.Background(), serviceName, funcName, reqObj)
+}
+
+func (p *Pipeline) CallNoReturnContext(ctx context.Context, serviceName string, funcName string, reqObj interface{}) error {
+	_, err := p.callNoReturnContext(ctx, serviceName, funcName, reqObj)
+	return err
+}
+
+// run CallNoReturn through the middlewares, not retried.
+func (p *Pipeline) callNoReturnContext(ctx context.Context, serviceName string, funcName string, reqObj interface{}) (int32, error) {
+	if len(p.middlewares) == 0 {
+		return p.callNoReturnByName(ctx, serviceName, funcName, reqObj, nil)
+	}
+
+	invoker := ChainClientMiddlewares(p.callNoReturnByName, p.middlewares...)
+	return invoker(ctx, serviceName, funcName, reqObj, nil)
+}
+
+func (p *Pipeline) callNoReturnByName(ctx context.Context, serviceName string, funcName string, reqObj interface{}, respObj interface{}) (int32, error) {
+	code := RES_CODE_SYS_ERR
+
+	inter := p.getInter()
+	if inter == nil {
+		return code, p.ec.Throw("callNoReturnByName", ErrPipelineInterNil)
 	}
 
 	fullFuncName := GetFullFuncName(serviceName, funcName)
-	params, err := p.inter.OnMarshal(fullFuncName, reqObj)
+	params, err := inter.OnMarshal(fullFuncName, reqObj)
 	if err != nil {
-		return p.ec.Throw("CallNoReturn", err)
+		return code, p.ec.Throw("callNoReturnByName", err)
 	}
 
-	_, _, err = p.CallByFuncName(serviceName, funcName, true, params)
-	return p.ec.Throw("CallNoReturn", err)
+	code, _, err = p.CallByFuncNameContext(ctx, serviceName, funcName, true, params)
+	return code, p.ec.Throw("callNoReturnByName", err)
 }
 
 func (p *Pipeline) CallByFuncName(serviceName string, funcName string, bNoReturn bool, params ...[]byte) (int32, []byte, error) {
+	return p.CallByFuncNameContext(context.Background(), serviceName, funcName, bNoReturn, params...)
+}
+
+func (p *Pipeline) CallByFuncNameContext(ctx context.Context, serviceName string, funcName string, bNoReturn bool, params ...[]byte) (int32, []byte, error) {
 	fullFuncName := GetFullFuncName(serviceName, funcName)
-	funcNo, ok := p.mapFuncName2No[fullFuncName]
+	funcNo, ok := p.getFuncNo(fullFuncName)
 	if !ok {
-		return RES_CODE_SYS_ERR, nil, p.ec.Throw("CallByFuncName", ErrPipelineNotSupportFunc)
+		return RES_CODE_NOT_FOUND, nil, p.ec.Throw("CallByFuncNameContext", wrapNotSent(ErrPipelineNotSupportFunc))
 	}
 
-	code, payload, err := p.CallByFuncNo(funcNo, bNoReturn, params...)
+	code, payload, respHeader, err := p.callByFuncNo(ctx, funcNo, bNoReturn, params...)
 	if err != nil {
-		return code, nil, p.ec.Throw("CallByFuncName", err)
+		return code, nil, p.ec.Throw("CallByFuncNameContext", err)
 	}
 
 	if code != RES_CODE_SUCC {
-		err = errors.New(string(payload))
-		return code, nil, p.ec.Throw("CallByFuncName", err)
+		err = DecodeRpcError(respHeader, payload)
+		return code, nil, p.ec.Throw("CallByFuncNameContext", err)
 	}
 
 	return code, payload, nil
 }
 
 func (p *Pipeline) CallByFuncNo(funcNo uint16, bNoReturn bool, params ...[]byte) (int32, []byte, error) {
-	var err error = nil
-	defer p.ec.DeferThrow("callByFuncNo", &err)
+	return p.CallByFuncNoContext(context.Background(), funcNo, bNoReturn, params...)
+}
 
-	code := RES_CODE_SYS_ERR
-	if p.net == nil {
-		err = ErrPipelineNetNil
-		return code, nil, err
+// Call by func No., the wait is aborted when ctx is done.
+// @param ctx, the context.
+// @param funcNo, the func No.
+// @param bNoReturn, true if not wait for the response.
+// @param params, the request payload.
+// @return int32, the response code.
+// @return []byte, the response payload, an encoded error if the code is not RES_CODE_SUCC.
+// @return error, ctx.Err() if ctx is done.
+func (p *Pipeline) CallByFuncNoContext(ctx context.Context, funcNo uint16, bNoReturn bool, params ...[]byte) (int32, []byte, error) {
+	code, payload, _, err := p.callByFuncNo(ctx, funcNo, bNoReturn, params...)
+	return code, payload, p.ec.Throw("CallByFuncNoContext", err)
+}
+
+func (p *Pipeline) callByFuncNo(ctx context.Context, funcNo uint16, bNoReturn bool, params ...[]byte) (code int32, respPayload []byte, respHeader *PackHeader, err error) {
+	defer func() {
+		if err != nil {
+			code = GetErrorCode(err)
+		}
+	}()
+
+	code = RES_CODE_SYS_ERR
+	if p.getNet() == nil {
+		err = wrapNotSent(ErrPipelineNetNil)
+		return code, nil, nil, err
+	}
+
+	err = ctx.Err()
+	if err != nil {
+		err = wrapNotSent(err)
+		return code, nil, nil, err
 	}
 
 	if bNoReturn {
-		err := p.callNoReturnImpl(funcNo, params...)
+		err = p.callNoReturnImpl(ctx, funcNo, params...)
 		if err == nil {
 			code = RES_CODE_SUCC
 		}
 
-		return code, nil, err
+		return code, nil, nil, err
 	}
 
-	// add to list
-	req, payload, err := p.addRequest(funcNo, params...)
+	// add to list and send
+	p.lckWire.RLock()
+	req, err := p.sendRequest(ctx, funcNo, params...)
+	p.lckWire.RUnlock()
 	if err != nil {
-		return code, nil, err
+		return code, nil, nil, err
 	}
 
-	defer p.stopRequest(req.Header.SerialNo)
+	// go c.readPack()
 
-	// send
-	err = p.net.WriteRpcPack(p.peerType, p.peerNo, payload...)
+	code, respPayload, respHeader, err = p.waitResponse(ctx, req)
+	return code, respPayload, respHeader, err
+}
+
+// add the request and send it, lckWire is held by the caller.
+func (p *Pipeline) sendRequest(ctx context.Context, funcNo uint16, params ...[]byte) (*Request, error) {
+	req, payload, err := p.addRequest(ctx, funcNo, params...)
 	if err != nil {
-		return code, nil, err
+		return nil, wrapNotSent(err)
 	}
 
-	// go c.readPack()
+	err = p.getNet().WriteRpcPack(p.peerType, p.peerNo, payload...)
+	if err != nil {
+		p.stopRequest(req.Header.GetSerialNo())
+		if errors.Is(err, ErrNetNotConnected) {
+			err = wrapNotSent(err)
+		}
+
+		return nil, err
+	}
 
-	// wait
-	err = p.wait(req)
+	return req, nil
+}
+
+// wait the response of a sent request, then remove the request.
+func (p *Pipeline) waitResponse(ctx context.Context, req *Request) (int32, []byte, *PackHeader, error) {
+	defer p.stopRequest(req.Header.GetSerialNo())
+
+	code := RES_CODE_SYS_ERR
+	err := p.waitContext(ctx, req)
 	if err != nil {
-		return code, nil, err
+		return code, nil, nil, err
 	}
 
 	// get response
-	_, ok := p.getRequest(req.Header.SerialNo)
+	_, ok := p.getRequest(req.Header.GetSerialNo())
 	if !ok {
-		err = ErrPipelineForceCallStop
-		return code, nil, err
+		return code, nil, nil, ErrPipelineForceCallStop
 	}
 
+	p.fillTrailer(ctx, req)
 	code, respPayload := req.GetResponse()
-	return code, respPayload, nil
+	respHeader := req.GetResponseHeader()
+	respPayload, err = decompressHeaderPayload(respHeader, respPayload)
+	if err != nil {
+		return code, nil, nil, err
+	}
+
+	return code, respPayload, respHeader, nil
+}
+
+// Call a stream func, the response messages are received by the returned stream.
+// The timeout of the pipeline is not used, close the stream or use ctx to stop it.
+// @param ctx, the context, the stream is closed when ctx is done.
+// @param serviceName, the service name.
+// @param funcName, the func name.
+// @param reqObj, the request object.
+// @return *ClientStream, the stream.
+// @return error, error.
+func (p *Pipeline) CallStream(ctx context.Context, serviceName string, funcName string, reqObj interface{}) (*ClientStream, error) {
+	inter := p.getInter()
+	if inter == nil {
+		return nil, p.ec.Throw("CallStream", ErrPipelineInterNil)
+	}
+
+	fullFuncName := GetFullFuncName(serviceName, funcName)
+	funcNo, ok := p.getFuncNo(fullFuncName)
+	if !ok {
+		return nil, p.ec.Throw("CallStream", ErrPipelineNotSupportFunc)
+	}
+
+	params, err := inter.OnMarshal(fullFuncName, reqObj)
+	if err != nil {
+		return nil, p.ec.Throw("CallStream", err)
+	}
+
+	stream, err := p.callStream(ctx, funcNo, fullFuncName, params)
+	return stream, p.ec.Throw("CallStream", err)
+}
+
+// Open a stream without request object, the messages are sent by ClientStream.Send,
+// for client-streaming and bidirectional streaming.
+// @param ctx, the context, the stream is closed when ctx is done.
+// @param serviceName, the service name.
+// @param funcName, the func name.
+// @return *ClientStream, the stream.
+// @return error, error.
+func (p *Pipeline) OpenStream(ctx context.Context, serviceName string, funcName string) (*ClientStream, error) {
+	fullFuncName := GetFullFuncName(serviceName, funcName)
+	funcNo, ok := p.getFuncNo(fullFuncName)
+	if !ok {
+		return nil, p.ec.Throw("OpenStream", ErrPipelineNotSupportFunc)
+	}
+
+	stream, err := p.callStream(ctx, funcNo, fullFuncName)
+	return stream, p.ec.Throw("OpenStream", err)
+}
+
+func (p *Pipeline) CallStreamByFuncNo(ctx context.Context, funcNo uint16, params ...[]byte) (*ClientStream, error) {
+	stream, err := p.callStream(ctx, funcNo, "", params...)
+	return stream, p.ec.Throw("CallStreamByFuncNo", err)
+}
+
+func (p *Pipeline) callStream(ctx context.Context, funcNo uint16, funcName string, params ...[]byte) (*ClientStream, error) {
+	if p.getNet() == nil {
+		return nil, ErrPipelineNetNil
+	}
+
+	err := ctx.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	p.lckWire.RLock()
+	stream, err := p.sendStream(ctx, funcNo, funcName, params...)
+	p.lckWire.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	stream.watchContext()
+	return stream, nil
 }
 
-func (p *Pipeline) callNoReturnImpl(funcNo uint16, params ...[]byte) error {
+// add the stream and send the open pack, lckWire is held by the caller.
+func (p *Pipeline) sendStream(ctx context.Context, funcNo uint16, funcName string, params ...[]byte) (*ClientStream, error) {
+	if p.GetAgreedHeaderVersion() == RPC_HEADER_VER_1 {
+		return nil, ErrStreamNeedV2
+	}
+
+	stream, payload, err := p.addStream(ctx, funcNo, funcName, params...)
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.getNet().WriteRpcPack(p.peerType, p.peerNo, payload...)
+	if err != nil {
+		p.removeStream(stream.Header.GetSerialNo())
+		return nil, err
+	}
+
+	return stream, nil
+}
+
+// register the stream, the payload is built outside lckRequests.
+func (p *Pipeline) addStream(ctx context.Context, funcNo uint16, funcName string, params ...[]byte) (*ClientStream, []ByteArray, error) {
+	stream, err := p.registerStream(ctx, funcNo, funcName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	payload, err := p.newRequestPayload(ctx, stream.Header, params)
+	if err != nil {
+		p.removeStream(stream.Header.GetSerialNo())
+		return nil, nil, err
+	}
+
+	return stream, payload, nil
+}
+
+func (p *Pipeline) registerStream(ctx context.Context, funcNo uint16, funcName string) (*ClientStream, error) {
+	p.lckRequests.Lock()
+	defer p.lckRequests.Unlock()
+
+	sno, err := p.allocSerialNo()
+	if err != nil {
+		return nil, err
+	}
+
+	h, err := p.newRequestHeader(ctx, sno, funcNo)
+	if err != nil {
+		return nil, err
+	}
+
+	h.SetFlag(RPC_FLAG_STREAM)
+	stream := newClientStream(ctx, p, h, funcName)
+	p.maxSerialNo = sno
+	p.mapSno2Stream[sno] = stream
+	return stream, nil
+}
+
+func (p *Pipeline) getStream(sno uint32) (*ClientStream, bool) {
+	p.lckRequests.Lock()
+	defer p.lckRequests.Unlock()
+
+	stream, ok := p.mapSno2Stream[sno]
+	return stream, ok
+}
+
+func (p *Pipeline) removeStream(sno uint32) {
+	p.lckRequests.Lock()
+	defer p.lckRequests.Unlock()
+
+	delete(p.mapSno2Stream, sno)
+}
+
+// write a pack after the open one, only the messages may be compressed.
+func (p *Pipeline) writeStreamPack(ctx context.Context, reqHeader *PackHeader, flags uint8, code int32, payload []byte) error {
+	h := NewVersionPackHeader(reqHeader.Version, p.mark, reqHeader.GetSerialNo(), reqHeader.FuncNo)
+	h.Code = code
+	h.SetFlag(flags | RPC_FLAG_STREAM)
+
+	var frames [][]byte = nil
+	if len(payload) > 0 {
+		frames = [][]byte{payload}
+	}
+
+	if !h.HasFlag(RPC_FLAG_STREAM_MSG) {
+		ctx = NewCompressContext(ctx, COMPRESS_TYPE_NONE)
+	}
+
+	packData, err := p.newRequestPayload(ctx, h, frames)
+	if err != nil {
+		return err
+	}
+
+	p.lckWire.RLock()
+	defer p.lckWire.RUnlock()
+
+	return p.getNet().WriteRpcPack(p.peerType, p.peerNo, packData...)
+}
+
+func (p *Pipeline) callNoReturnImpl(ctx context.Context, funcNo uint16, params ...[]byte) error {
 	var err error = nil
 	defer p.ec.DeferThrow("callNoReturnImpl", &err)
 
-	h := NewPackHeader(p.mark, 0, funcNo)
-	headerData, err := h.Marshal()
+	p.lckWire.RLock()
+	defer p.lckWire.RUnlock()
+
+	h, err := p.newRequestHeader(ctx, 0, funcNo)
 	if err != nil {
 		return err
 	}
 
-	payload := make([]ByteArray, 0)
-	payload = append(payload, headerData)
-	if len(params) > 0 {
-		payload = append(payload, params...)
+	if h.Version != RPC_HEADER_VER_1 {
+		h.SetFlag(RPC_FLAG_ONE_WAY)
 	}
 
-	err = p.net.WriteRpcPack(p.peerType, p.peerNo, payload...)
+	payload, err := p.newRequestPayload(ctx, h, params)
+	if err != nil {
+		return err
+	}
+
+	err = p.getNet().WriteRpcPack(p.peerType, p.peerNo, payload...)
 	return err
 }
 
@@ -301,34 +955,163 @@ func (p *Pipeline) callNoReturnImpl(funcNo uint16, params ...[]byte) error {
 // 	p.resetCurRequest()
 // }
 
-func (p *Pipeline) addRequest(funcNo uint16, params ...[]byte) (*Request, []ByteArray, error) {
-	p.lckRequests.Lock()
-	defer p.lckRequests.Unlock()
+// create the header with the agreed version, lckWire is held by the caller.
+func (p *Pipeline) newRequestHeader(ctx context.Context, sno uint32, funcNo uint16) (*PackHeader, error) {
+	h := NewVersionPackHeader(p.GetAgreedHeaderVersion(), p.mark, sno, funcNo)
+	if h.Version != RPC_HEADER_VER_1 {
+		p.lckInter.RLock()
+		if funcNo == RPC_FUNC_NO_FUNC_LIST && len(p.codecs) > 0 {
+			names := make([]string, 0, len(p.codecs))
+			for _, codec := range p.codecs {
+				names = append(names, codec.GetName())
+			}
+
+			h.SetExt(RPC_EXT_CODEC_LIST, []byte(strings.Join(names, ",")))
+		} else if p.codecName != "" && !p.isFuncRouted(funcNo) {
+			h.SetExt(RPC_EXT_CODEC, []byte(p.codecName))
+		}
+
+		p.lckInter.RUnlock()
+	}
+
+	md, ok := FromOutgoingContext(ctx)
+	if ok {
+		err := setHeaderMetadata(h, md)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return h, nil
+}
+
+// compress the params if need, then marshal the header before them.
+func (p *Pipeline) newRequestPayload(ctx context.Context, h *PackHeader, params [][]byte) ([]ByteArray, error) {
+	compressType, ok := fromCompressContext(ctx)
+	if !ok {
+		compressType = p.compressType
+	}
+
+	var err error = nil
+	if compressType != COMPRESS_TYPE_NONE && h.Version != RPC_HEADER_VER_1 {
+		params, err = compressHeaderPayload(h, compressType, p.threshold, params)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	sno := p.maxSerialNo + 1
-	h := NewPackHeader(p.mark, sno, funcNo)
 	headerData, err := h.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	payload := make([]ByteArray, 0)
+	payload = append(payload, headerData)
+	if len(params) > 0 {
+		payload = append(payload, params...)
+	}
+
+	return payload, nil
+}
+
+func (p *Pipeline) fillTrailer(ctx context.Context, req *Request) {
+	trailer, ok := fromTrailerContext(ctx)
+	if !ok {
+		return
+	}
+
+	respHeader := req.GetResponseHeader()
+	if respHeader == nil {
+		return
+	}
+
+	md, err := getHeaderMetadata(respHeader)
+	if err != nil {
+		p.ec.Catch("fillTrailer", &err)
+		return
+	}
+
+	*trailer = md
+}
+
+// register the request, the payload is built outside lckRequests
+// because the compression may take a while.
+func (p *Pipeline) addRequest(ctx context.Context, funcNo uint16, params ...[]byte) (*Request, []ByteArray, error) {
+	req, err := p.registerRequest(ctx, funcNo, params...)
 	if err != nil {
 		return nil, nil, p.ec.Throw("addRequest", err)
 	}
 
+	payload, err := p.newRequestPayload(ctx, req.Header, params)
+	if err != nil {
+		p.removeRequest(req.Header.GetSerialNo())
+		return nil, nil, p.ec.Throw("addRequest", err)
+	}
+
+	return req, payload, nil
+}
+
+func (p *Pipeline) registerRequest(ctx context.Context, funcNo uint16, params ...[]byte) (*Request, error) {
+	p.lckRequests.Lock()
+	defer p.lckRequests.Unlock()
+
+	sno, err := p.allocSerialNo()
+	if err != nil {
+		return nil, err
+	}
+
+	h, err := p.newRequestHeader(ctx, sno, funcNo)
+	if err != nil {
+		return nil, err
+	}
+
 	req := NewRequest(h)
 	if len(params) > 0 {
 		req.AddFrames(params...)
 	}
 
-	payload := make([]ByteArray, 0)
-	payload = append(payload, headerData)
-	if len(params) > 0 {
-		payload = append(payload, params...)
+	p.maxSerialNo = sno
+	p.mapSno2Req[sno] = req
+	return req, nil
+}
+
+func (p *Pipeline) removeRequest(sno uint32) {
+	p.lckRequests.Lock()
+	defer p.lckRequests.Unlock()
+
+	delete(p.mapSno2Req, sno)
+}
+
+// alloc a serial No. after the last one, skip 0 (no return) and the in-flight ones.
+func (p *Pipeline) allocSerialNo() (uint32, error) {
+	maxSno := GetMaxSerialNo(p.GetAgreedHeaderVersion())
+	if uint32(len(p.mapSno2Req)+len(p.mapSno2Stream)) >= maxSno {
+		return 0, ErrPipelineTooManyReqs
 	}
 
-	p.maxSerialNo++
-	p.mapSno2Req[sno] = req
-	return req, payload, nil
+	sno := p.maxSerialNo
+	for i := uint32(0); i < maxSno; i++ {
+		if sno >= maxSno {
+			sno = 1
+		} else {
+			sno++
+		}
+
+		_, ok := p.mapSno2Req[sno]
+		if ok {
+			continue
+		}
+
+		_, ok = p.mapSno2Stream[sno]
+		if !ok {
+			return sno, nil
+		}
+	}
+
+	return 0, ErrPipelineTooManyReqs
 }
 
-func (p *Pipeline) stopRequest(sno uint16) {
+func (p *Pipeline) stopRequest(sno uint32) {
 	p.lckRequests.Lock()
 	defer p.lckRequests.Unlock()
 
@@ -339,18 +1122,24 @@ func (p *Pipeline) stopRequest(sno uint16) {
 	}
 }
 
-func (p *Pipeline) stopAllRequest() {
+// stop all the requests and streams, they return err.
+func (p *Pipeline) stopAllRequest(err error) {
 	p.lckRequests.Lock()
 	defer p.lckRequests.Unlock()
 
 	for _, req := range p.mapSno2Req {
-		req.Cancel()
+		req.CancelWithError(err)
+	}
+
+	for _, stream := range p.mapSno2Stream {
+		stream.que.end(err, nil)
 	}
 
-	p.mapSno2Req = make(map[uint16]*Request)
+	p.mapSno2Req = make(map[uint32]*Request)
+	p.mapSno2Stream = make(map[uint32]*ClientStream)
 }
 
-func (p *Pipeline) getRequest(sno uint16) (*Request, bool) {
+func (p *Pipeline) getRequest(sno uint32) (*Request, bool) {
 	p.lckRequests.Lock()
 	defer p.lckRequests.Unlock()
 
@@ -368,20 +1157,72 @@ func (p *Pipeline) wait(req *Request) error {
 
 	if err != nil {
 		p.logger.W(err.Error())
-		return err
+
+		errCancel := req.GetCancelError()
+		if errCancel != nil {
+			return errCancel
+		}
+
+		// still in the list means not canceled
+		_, ok := p.getRequest(req.Header.GetSerialNo())
+		if ok {
+			return ErrPipelineCallTimeout
+		}
+
+		return ErrPipelineForceCallStop
 	}
 
 	return nil
 }
 
+func (p *Pipeline) waitContext(ctx context.Context, req *Request) error {
+	if ctx.Done() == nil {
+		return p.wait(req)
+	}
+
+	chanWaitEnd := make(chan struct{})
+	defer close(chanWaitEnd)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			p.stopRequest(req.Header.GetSerialNo())
+		case <-chanWaitEnd:
+		}
+	}()
+
+	err := p.wait(req)
+	ctxErr := ctx.Err()
+	if ctxErr != nil {
+		return ctxErr
+	}
+
+	return err
+}
+
+// read until the net is closed, then reconnect if a net factory is set.
 func (p *Pipeline) readPackLoop() {
 	for {
-		data, err := p.net.ReadRpcPack()
+		p.readPacks(p.getNet())
+		if p.IsStopped() {
+			return
+		}
+
+		p.handleTransportLost()
+		if !p.reconnect() {
+			return
+		}
+	}
+}
+
+func (p *Pipeline) readPacks(net Net) {
+	for {
+		data, err := net.ReadRpcPack()
 		if err != nil {
 			break
 		}
 
-		h := NewPackHeader(p.mark, 0, 0)
+		h := NewVersionPackHeader(p.GetAgreedHeaderVersion(), p.mark, 0, 0)
 		err = h.Unmarshal(data.Payload)
 		if err != nil {
 			p.ec.Catch("readPackLoop", &err)
@@ -389,21 +1230,79 @@ func (p *Pipeline) readPackLoop() {
 		}
 
 		headerLen := h.GetHeaderLen()
-		p.handlePack(h.SerialNo, h.FuncNo, h.Code, data.Payload[headerLen:])
+		payload := data.Payload[headerLen:]
+		p.switchHeaderVersion(h, payload)
+		p.handlePack(h, payload)
 	}
 }
 
-func (p *Pipeline) handlePack(serialNo uint16, funcNo uint16, code int32, payload []byte) {
-	req, ok := p.getRequest(serialNo)
+func (p *Pipeline) getFuncNo(fullFuncName string) (uint16, bool) {
+	p.lckFuncs.RLock()
+	defer p.lckFuncs.RUnlock()
+
+	funcNo, ok := p.mapFuncName2No[fullFuncName]
+	return funcNo, ok
+}
+
+func (p *Pipeline) getFuncName(funcNo uint16) (string, bool) {
+	p.lckFuncs.RLock()
+	defer p.lckFuncs.RUnlock()
+
+	fullFuncName, ok := p.mapFuncNo2Name[funcNo]
+	return fullFuncName, ok
+}
+
+// check if the RouteInterceptor route the func to another interceptor than the negotiated
+// default one, the codec name is not sent for such a func and the peer decide it by its route.
+// lckInter is held by the caller.
+func (p *Pipeline) isFuncRouted(funcNo uint16) bool {
+	route, ok := p.inter.(*RouteInterceptor)
+	if !ok {
+		return false
+	}
+
+	fullFuncName, ok := p.getFuncName(funcNo)
+	if !ok {
+		return false
+	}
+
+	return route.GetInterceptor(fullFuncName) != route.GetDefaultInterceptor()
+}
+
+func (p *Pipeline) getNet() Net {
+	p.lckNet.RLock()
+	defer p.lckNet.RUnlock()
+
+	return p.net
+}
+
+func (p *Pipeline) handlePack(h *PackHeader, payload []byte) {
+	// serial No. 0 is never allocated, it is a push
+	if h.GetSerialNo() == 0 {
+		p.handlePush(h, payload)
+		return
+	}
+
+	if h.HasFlag(RPC_FLAG_STREAM) {
+		stream, ok := p.getStream(h.GetSerialNo())
+		if ok && h.FuncNo == stream.Header.FuncNo {
+			stream.handlePack(h, payload)
+		}
+
+		return
+	}
+
+	req, ok := p.getRequest(h.GetSerialNo())
 	if !ok {
 		return
 	}
 
-	if funcNo != req.Header.FuncNo {
+	if h.FuncNo != req.Header.FuncNo {
 		return
 	}
 
 	// req.respPayload = payload
-	req.SetResponse(code, payload)
+	req.SetResponseHeader(h)
+	req.SetResponse(h.Code, payload)
 	req.Signal()
 }
@@ -0,0 +1,143 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPipelineCall(t *testing.T) {
+	srv, a, _ := newTestServer(t, RPC_HEADER_VER_1, &testEchoService{no: 1})
+	p := newTestPipeline(t, RPC_HEADER_VER_1, srv, a)
+
+	resp := &testResp{}
+	code, err := p.Call("Echo", "Say", &testReq{Msg: "a"}, resp)
+	if err != nil || code != RES_CODE_SUCC {
+		t.Fatal(code, err)
+	}
+
+	if resp.Msg != "1:a" {
+		t.Fatalf("resp %q, want %q", resp.Msg, "1:a")
+	}
+
+	if p.GetPendingCount() != 0 {
+		t.Fatalf("pending %d, want 0", p.GetPendingCount())
+	}
+}
+
+func TestPipelineCallContextCancel(t *testing.T) {
+	srv, a, _ := newTestServer(t, RPC_HEADER_VER_1, &testEchoService{no: 1, delay: time.Second})
+	p := newTestPipeline(t, RPC_HEADER_VER_1, srv, a)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	chanErr := make(chan error, 1)
+	go func() {
+		_, err := p.CallContext(ctx, "Echo", "Say", &testReq{}, &testResp{})
+		chanErr <- err
+	}()
+
+	if !waitTestCond(time.Second, func() bool { return p.GetPendingCount() == 1 }) {
+		t.Fatal("call not sent")
+	}
+
+	cancel()
+	select {
+	case err := <-chanErr:
+		if !errors.Is(err, context.Canceled) || GetErrorCode(err) != RES_CODE_CANCELLED {
+			t.Fatalf("err %v, want %v", err, context.Canceled)
+		}
+
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("call not canceled")
+	}
+
+	if p.GetPendingCount() != 0 {
+		t.Fatalf("pending %d after cancel, want 0", p.GetPendingCount())
+	}
+
+	// a done context is not sent
+	_, err := p.CallContext(ctx, "Echo", "Say", &testReq{}, &testResp{})
+	if !errors.Is(err, context.Canceled) || !IsNotSent(err) {
+		t.Fatalf("done context: %v", err)
+	}
+}
+
+func TestPipelineCallContextDeadline(t *testing.T) {
+	srv, a, _ := newTestServer(t, RPC_HEADER_VER_1, &testEchoService{no: 1, delay: time.Second})
+	p := newTestPipeline(t, RPC_HEADER_VER_1, srv, a)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := p.CallContext(ctx, "Echo", "Say", &testReq{}, &testResp{})
+	if !errors.Is(err, context.DeadlineExceeded) || GetErrorCode(err) != RES_CODE_TIMEOUT {
+		t.Fatalf("err %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	if time.Since(start) >= 500*time.Millisecond {
+		t.Fatalf("deadline call take %v", time.Since(start))
+	}
+
+	if p.GetPendingCount() != 0 {
+		t.Fatalf("pending %d after the deadline, want 0", p.GetPendingCount())
+	}
+}
+
+func TestPipelineSerialNoWrap(t *testing.T) {
+	a, _ := NewLoopbackNetPair(TEST_CLIENT_PEER_TYPE, TEST_CLIENT_PEER_NO, TEST_SERVER_PEER_TYPE, TEST_SERVER_PEER_NO, TEST_MAX_READ_QUE)
+	p := NewPipeline(a, TEST_SERVER_PEER_TYPE, TEST_SERVER_PEER_NO, TEST_MARK)
+
+	// the max one, then wrap to 1 which is in flight, so 2
+	p.maxSerialNo = RPC_MAX_SERIAL_NO_V1 - 1
+	p.mapSno2Req[1] = nil
+	for _, want := range []uint32{RPC_MAX_SERIAL_NO_V1, 2} {
+		sno, err := p.allocSerialNo()
+		if err != nil || sno != want {
+			t.Fatalf("serial No. %d %v, want %d", sno, err, want)
+		}
+
+		p.maxSerialNo = sno
+		p.mapSno2Req[sno] = nil
+	}
+
+	// v2 go on after the v1 max
+	p.wireVer = int32(RPC_HEADER_VER_2)
+	p.maxSerialNo = RPC_MAX_SERIAL_NO_V1
+	sno, err := p.allocSerialNo()
+	if err != nil || sno != RPC_MAX_SERIAL_NO_V1+1 {
+		t.Fatalf("v2 serial No. %d %v, want %d", sno, err, RPC_MAX_SERIAL_NO_V1+1)
+	}
+}
+
+func TestPipelineTooManyRequests(t *testing.T) {
+	a, _ := NewLoopbackNetPair(TEST_CLIENT_PEER_TYPE, TEST_CLIENT_PEER_NO, TEST_SERVER_PEER_TYPE, TEST_SERVER_PEER_NO, TEST_MAX_READ_QUE)
+	p := NewPipeline(a, TEST_SERVER_PEER_TYPE, TEST_SERVER_PEER_NO, TEST_MARK)
+	for sno := uint32(1); sno <= RPC_MAX_SERIAL_NO_V1; sno++ {
+		p.mapSno2Req[sno] = nil
+	}
+
+	_, err := p.allocSerialNo()
+	if !errors.Is(err, ErrPipelineTooManyReqs) {
+		t.Fatalf("all serial No. in flight: %v", err)
+	}
+
+	// a call fail without sending
+	p.mapFuncName2No[GetFullFuncName("Echo", "Say")] = RPC_FUNC_NO_FUNC_LIST + 1
+	_, _, err = p.CallByFuncName("Echo", "Say", false, []byte("{}"))
+	if !errors.Is(err, ErrPipelineTooManyReqs) {
+		t.Fatalf("call with all serial No. in flight: %v", err)
+	}
+
+	// one is free again
+	delete(p.mapSno2Req, 100)
+	sno, err := p.allocSerialNo()
+	if err != nil || sno != 100 {
+		t.Fatalf("serial No. %d %v, want 100", sno, err)
+	}
+}
@@ -0,0 +1,275 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"errors"
+	"sync"
+)
+
+var (
+	ErrPushHandlerNil  = errors.New("push handler is nil")
+	ErrPushFuncNoExist = errors.New("push func not exist")
+)
+
+// Handle a push pack, called in the read goroutine of the pipeline, should not block.
+// @param h, the header of the push pack.
+// @param payload, the payload, already decompressed.
+type PushHandleFunc func(h *PackHeader, payload []byte)
+
+// Peer is a peer seen by the server.
+type Peer struct {
+	PeerType uint32
+	PeerNo   uint32
+
+	headerVer uint8
+	lck       *sync.Mutex
+}
+
+func newPeer(peerType uint32, peerNo uint32) *Peer {
+	return &Peer{
+		PeerType:  peerType,
+		PeerNo:    peerNo,
+		headerVer: RPC_HEADER_VER_1,
+		lck:       &sync.Mutex{},
+	}
+}
+
+// Get the header version agreed with the peer.
+func (p *Peer) GetHeaderVersion() uint8 {
+	p.lck.Lock()
+	defer p.lck.Unlock()
+
+	return p.headerVer
+}
+
+func (p *Peer) setHeaderVersion(version uint8) {
+	p.lck.Lock()
+	defer p.lck.Unlock()
+
+	p.headerVer = version
+}
+
+//========================
+//       Registry
+//========================
+// Register a push func, it appear in the func list, so the clients can subscribe it by name.
+// The func can not be called.
+// @param serviceName, the service name.
+// @param funcName, the func name.
+// @return uint16, the func No.
+// @return error, error.
+func (r *Registry) RegisterPush(serviceName string, funcName string) (uint16, error) {
+	r.lck.Lock()
+	defer r.lck.Unlock()
+
+	fullFuncName := GetFullFuncName(serviceName, funcName)
+	_, ok := r.mapFuncName2No[fullFuncName]
+	if ok {
+		return 0, r.ec.Throw("RegisterPush", ErrRegistryFuncExist)
+	}
+
+	funcNo, err := r.allocFuncNo()
+	if err != nil {
+		return 0, r.ec.Throw("RegisterPush", err)
+	}
+
+	r.mapFuncName2No[fullFuncName] = funcNo
+	r.mapFuncNo2Name[funcNo] = fullFuncName
+	return funcNo, nil
+}
+
+//========================
+//       Pipeline
+//========================
+// Subscribe a push func by name, the func list must be fetched.
+// @param serviceName, the service name.
+// @param funcName, the func name.
+// @param handler, the handler.
+// @return error, error.
+func (p *Pipeline) Subscribe(serviceName string, funcName string, handler PushHandleFunc) error {
+	funcNo, ok := p.getFuncNo(GetFullFuncName(serviceName, funcName))
+	if !ok {
+		return p.ec.Throw("Subscribe", ErrPipelineNotSupportFunc)
+	}
+
+	err := p.SubscribeFuncNo(funcNo, handler)
+	return p.ec.Throw("Subscribe", err)
+}
+
+// Subscribe a push func by func No., replace the old handler.
+func (p *Pipeline) SubscribeFuncNo(funcNo uint16, handler PushHandleFunc) error {
+	if handler == nil {
+		return p.ec.Throw("SubscribeFuncNo", ErrPushHandlerNil)
+	}
+
+	p.lckPush.Lock()
+	defer p.lckPush.Unlock()
+
+	p.mapFuncNo2PushHandler[funcNo] = handler
+	return nil
+}
+
+func (p *Pipeline) Unsubscribe(funcNo uint16) {
+	p.lckPush.Lock()
+	defer p.lckPush.Unlock()
+
+	delete(p.mapFuncNo2PushHandler, funcNo)
+}
+
+func (p *Pipeline) handlePush(h *PackHeader, payload []byte) {
+	p.lckPush.RLock()
+	handler, ok := p.mapFuncNo2PushHandler[h.FuncNo]
+	p.lckPush.RUnlock()
+
+	if !ok {
+		return
+	}
+
+	payload, err := decompressHeaderPayload(h, payload)
+	if err != nil {
+		p.ec.Catch("handlePush", &err)
+		return
+	}
+
+	handler(h, payload)
+}
+
+//========================
+//        Server
+//========================
+// Push to a peer, the peer handle it by Pipeline.Subscribe.
+// @param peerType, the peer type.
+// @param peerNo, the peer No.
+// @param funcNo, the push func No.
+// @param payload, the payload.
+// @return error, error.
+func (s *Server) Push(peerType uint32, peerNo uint32, funcNo uint16, payload []byte) error {
+	err := s.push(peerType, peerNo, funcNo, payload)
+	return s.ec.Throw("Push", err)
+}
+
+// Marshal the object by the default interceptor and push it to a peer.
+func (s *Server) PushMsg(peerType uint32, peerNo uint32, serviceName string, funcName string, obj interface{}) error {
+	funcNo, payload, err := s.marshalPush(serviceName, funcName, obj)
+	if err != nil {
+		return s.ec.Throw("PushMsg", err)
+	}
+
+	err = s.push(peerType, peerNo, funcNo, payload)
+	return s.ec.Throw("PushMsg", err)
+}
+
+// Push to all the peers of a peer type.
+// @param peerType, the peer type.
+// @param funcNo, the push func No.
+// @param payload, the payload.
+// @return error, the first error, the other peers are still pushed.
+func (s *Server) Broadcast(peerType uint32, funcNo uint16, payload []byte) error {
+	err := s.broadcast(peerType, funcNo, payload)
+	return s.ec.Throw("Broadcast", err)
+}
+
+// Marshal the object by the default interceptor and push it to all the peers of a peer type.
+func (s *Server) BroadcastMsg(peerType uint32, serviceName string, funcName string, obj interface{}) error {
+	funcNo, payload, err := s.marshalPush(serviceName, funcName, obj)
+	if err != nil {
+		return s.ec.Throw("BroadcastMsg", err)
+	}
+
+	err = s.broadcast(peerType, funcNo, payload)
+	return s.ec.Throw("BroadcastMsg", err)
+}
+
+// Add a peer to push, the peers sending requests are added automatically.
+func (s *Server) AddPeer(peerType uint32, peerNo uint32) {
+	s.getOrAddPeer(peerType, peerNo)
+}
+
+// Remove a peer, the peers unreachable when push are removed automatically.
+// The header version agreed with it is forgotten.
+func (s *Server) RemovePeer(peerType uint32, peerNo uint32) {
+	s.lckPeers.Lock()
+	defer s.lckPeers.Unlock()
+
+	delete(s.mapPeerId2Peer, GetPeerId(peerType, peerNo))
+}
+
+// Get the peers of a peer type.
+func (s *Server) GetPeers(peerType uint32) []*Peer {
+	s.lckPeers.Lock()
+	defer s.lckPeers.Unlock()
+
+	peers := make([]*Peer, 0)
+	for _, peer := range s.mapPeerId2Peer {
+		if peer.PeerType == peerType {
+			peers = append(peers, peer)
+		}
+	}
+
+	return peers
+}
+
+func (s *Server) getOrAddPeer(peerType uint32, peerNo uint32) *Peer {
+	peerId := GetPeerId(peerType, peerNo)
+
+	s.lckPeers.Lock()
+	defer s.lckPeers.Unlock()
+
+	peer, ok := s.mapPeerId2Peer[peerId]
+	if !ok {
+		peer = newPeer(peerType, peerNo)
+		s.mapPeerId2Peer[peerId] = peer
+	}
+
+	return peer
+}
+
+// a new connection of the peer start with v1.
+func (s *Server) resetPeer(peerType uint32, peerNo uint32) {
+	s.getOrAddPeer(peerType, peerNo).setHeaderVersion(RPC_HEADER_VER_1)
+}
+
+func (s *Server) marshalPush(serviceName string, funcName string, obj interface{}) (uint16, []byte, error) {
+	funcNo, ok := s.registry.GetFuncNo(serviceName, funcName)
+	if !ok {
+		return 0, nil, ErrPushFuncNoExist
+	}
+
+	inter := s.registry.GetInterceptor()
+	if inter == nil {
+		return 0, nil, ErrRegistryInterNil
+	}
+
+	payload, err := inter.OnMarshal(GetFullFuncName(serviceName, funcName), obj)
+	return funcNo, payload, err
+}
+
+func (s *Server) broadcast(peerType uint32, funcNo uint16, payload []byte) error {
+	var firstErr error = nil
+	for _, peer := range s.GetPeers(peerType) {
+		err := s.push(peer.PeerType, peer.PeerNo, funcNo, payload)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// the push pack has serial No. 0, and RPC_FLAG_ONE_WAY with header v2.
+func (s *Server) push(peerType uint32, peerNo uint32, funcNo uint16, payload []byte) error {
+	if s.net == nil {
+		return ErrServerNetNil
+	}
+
+	h := NewPackHeader(s.mark, 0, funcNo)
+	err := s.writePeerPack(peerType, peerNo, h, [][]byte{payload})
+	if err != nil && GetErrorCode(err) == RES_CODE_UNAVAILABLE {
+		s.RemovePeer(peerType, peerNo)
+	}
+
+	return err
+}
@@ -0,0 +1,178 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"testing"
+	"time"
+)
+
+// subscribe Notice.Hello, the messages are sent to the returned channel.
+func subscribeTestPush(t *testing.T, p *Pipeline) chan string {
+	chanMsg := make(chan string, 16)
+	err := p.Subscribe("Notice", "Hello", func(h *PackHeader, payload []byte) {
+		resp := &testResp{}
+		err := p.getInter().OnUnmarshal("Notice.Hello", payload, resp)
+		if err != nil || h.GetSerialNo() != 0 {
+			resp.Msg = "bad push"
+		}
+
+		chanMsg <- resp.Msg
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return chanMsg
+}
+
+func waitTestPush(chanMsg chan string, timeout time.Duration) (string, bool) {
+	select {
+	case msg := <-chanMsg:
+		return msg, true
+	case <-time.After(timeout):
+		return "", false
+	}
+}
+
+func TestPushSubscribe(t *testing.T) {
+	srv, a, _ := newTestServer(t, RPC_HEADER_VER_2, nil)
+	_, err := srv.GetRegistry().RegisterPush("Notice", "Hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := newTestPipeline(t, RPC_HEADER_VER_2, srv, a)
+	chanMsg := subscribeTestPush(t, p)
+
+	err = srv.PushMsg(TEST_CLIENT_PEER_TYPE, TEST_CLIENT_PEER_NO, "Notice", "Hello", &testResp{Msg: "hi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, ok := waitTestPush(chanMsg, time.Second)
+	if !ok || msg != "hi" {
+		t.Fatalf("push %q %v, want %q", msg, ok, "hi")
+	}
+
+	// not subscribed, dropped
+	funcNo, _ := p.getFuncNo("Notice.Hello")
+	p.Unsubscribe(funcNo)
+	err = srv.PushMsg(TEST_CLIENT_PEER_TYPE, TEST_CLIENT_PEER_NO, "Notice", "Hello", &testResp{Msg: "again"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, ok = waitTestPush(chanMsg, 100*time.Millisecond)
+	if ok {
+		t.Fatalf("push %q after unsubscribe", msg)
+	}
+
+	// the push func can not be called
+	_, err = p.Call("Notice", "Hello", &testReq{}, &testResp{})
+	if err == nil {
+		t.Fatal("push func called")
+	}
+
+	err = srv.PushMsg(TEST_CLIENT_PEER_TYPE, TEST_CLIENT_PEER_NO, "Notice", "Bye", &testResp{})
+	if GetErrorCode(err) == RES_CODE_SUCC {
+		t.Fatal("push a func not registered")
+	}
+}
+
+func TestPushBroadcast(t *testing.T) {
+	server, err := ListenTCPNet("127.0.0.1:0", TEST_SERVER_PEER_TYPE, TEST_SERVER_PEER_NO, TEST_MAX_READ_QUE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := NewServer(server, TEST_MARK)
+	srv.SetInterceptor(&JsonInterceptor{})
+	_, err = srv.GetRegistry().RegisterPush("Notice", "Hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go srv.Start()
+	t.Cleanup(srv.Stop)
+
+	// 3 clients of the peer type with both header versions, and one of another peer type
+	clients := []struct {
+		peerType uint32
+		peerNo   uint32
+		ver      uint8
+	}{
+		{TEST_CLIENT_PEER_TYPE, 1, RPC_HEADER_VER_1},
+		{TEST_CLIENT_PEER_TYPE, 2, RPC_HEADER_VER_2},
+		{TEST_CLIENT_PEER_TYPE, 3, RPC_HEADER_VER_2},
+		{TEST_CLIENT_PEER_TYPE + 1, 1, RPC_HEADER_VER_2},
+	}
+
+	nets := make([]*TCPNet, 0, len(clients))
+	chanMsgs := make([]chan string, 0, len(clients))
+	for _, c := range clients {
+		client, err := DialTCPNet(server.Addr().String(), c.peerType, c.peerNo, TEST_MAX_READ_QUE)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p := NewPipeline(client, TEST_SERVER_PEER_TYPE, TEST_SERVER_PEER_NO, TEST_MARK)
+		p.SetHeaderVersion(c.ver)
+		p.SetInterceptor(&JsonInterceptor{})
+		p.SetTimeout(2)
+		go p.Start()
+		t.Cleanup(p.Stop)
+
+		// the server add the peer by the request
+		err = p.FetchFuncList()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		nets = append(nets, client)
+		chanMsgs = append(chanMsgs, subscribeTestPush(t, p))
+	}
+
+	err = srv.BroadcastMsg(TEST_CLIENT_PEER_TYPE, "Notice", "Hello", &testResp{Msg: "all"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, chanMsg := range chanMsgs {
+		msg, ok := waitTestPush(chanMsg, 200*time.Millisecond)
+		bWant := clients[i].peerType == TEST_CLIENT_PEER_TYPE
+		if ok != bWant || (ok && msg != "all") {
+			t.Fatalf("client %d-%d: push %q %v, want %v", clients[i].peerType, clients[i].peerNo, msg, ok, bWant)
+		}
+	}
+
+	// the unreachable peer is removed, the others are still pushed
+	nets[0].Close()
+	bLost := waitTestCond(time.Second, func() bool {
+		_, ok := server.getConn(GetPeerId(TEST_CLIENT_PEER_TYPE, 1))
+		return !ok
+	})
+
+	if !bLost {
+		t.Fatal("connection not lost")
+	}
+
+	err = srv.BroadcastMsg(TEST_CLIENT_PEER_TYPE, "Notice", "Hello", &testResp{Msg: "left"})
+	if GetErrorCode(err) != RES_CODE_UNAVAILABLE {
+		t.Fatalf("err %v, want code %d", err, RES_CODE_UNAVAILABLE)
+	}
+
+	if len(srv.GetPeers(TEST_CLIENT_PEER_TYPE)) != 2 {
+		t.Fatalf("peers %d, want 2", len(srv.GetPeers(TEST_CLIENT_PEER_TYPE)))
+	}
+
+	for _, chanMsg := range chanMsgs[1:3] {
+		msg, ok := waitTestPush(chanMsg, 200*time.Millisecond)
+		if !ok || msg != "left" {
+			t.Fatalf("push %q %v, want %q", msg, ok, "left")
+		}
+	}
+}
@@ -0,0 +1,189 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// pipeline states
+const (
+	PIPELINE_STATE_CONNECTED uint8 = iota
+	// the transport is lost, the in-flight calls fail with ErrPipelineTransportLost
+	PIPELINE_STATE_DISCONNECTED
+	// dialing a new net, or fetching the func list on it
+	PIPELINE_STATE_RECONNECTING
+	PIPELINE_STATE_STOPPED
+)
+
+// the timeout of the FetchFuncList after reconnected
+const RPC_RECONNECT_FETCH_TIMEOUT = 10 * time.Second
+
+// the min delay before dialing again
+const RPC_RECONNECT_MIN_DELAY = 10 * time.Millisecond
+
+// Create a new net to the same peer.
+type NetFactory func() (Net, error)
+
+// Called when the state of the pipeline change. DISCONNECTED and RECONNECTING are notified
+// in the read goroutine, CONNECTED in the goroutine fetching the func list after reconnect,
+// and STOPPED in the goroutine calling Stop, so the callback may run concurrently.
+// @param p, the pipeline.
+// @param state, the new state.
+// @param err, the reason, may be nil.
+type PipelineStateFunc func(p *Pipeline, state uint8, err error)
+
+// Reconnect by the factory when the transport is lost, and fetch the func list again
+// if it was fetched. The delay start at minDelay and double after each failure up to maxDelay.
+// @param factory, the net factory, nil to disable reconnect.
+// @param minDelay, the first delay, not less than RPC_RECONNECT_MIN_DELAY.
+// @param maxDelay, the max delay, not less than minDelay.
+func (p *Pipeline) SetReconnect(factory NetFactory, minDelay time.Duration, maxDelay time.Duration) {
+	if minDelay < RPC_RECONNECT_MIN_DELAY {
+		minDelay = RPC_RECONNECT_MIN_DELAY
+	}
+
+	if maxDelay < minDelay {
+		maxDelay = minDelay
+	}
+
+	p.lckNet.Lock()
+	defer p.lckNet.Unlock()
+
+	p.netFactory = factory
+	p.minDelay = minDelay
+	p.maxDelay = maxDelay
+}
+
+func (p *Pipeline) hasNetFactory() bool {
+	p.lckNet.RLock()
+	defer p.lckNet.RUnlock()
+
+	return p.netFactory != nil
+}
+
+// Set the callback of state changes, set it before Start.
+func (p *Pipeline) SetStateCallback(cb PipelineStateFunc) {
+	p.stateCb = cb
+}
+
+func (p *Pipeline) GetState() uint8 {
+	return uint8(atomic.LoadInt32(&p.state))
+}
+
+func (p *Pipeline) IsConnected() bool {
+	return p.GetState() == PIPELINE_STATE_CONNECTED
+}
+
+// the stopped state is final.
+func (p *Pipeline) setState(state uint8, err error) {
+	for {
+		oldState := atomic.LoadInt32(&p.state)
+		if uint8(oldState) == PIPELINE_STATE_STOPPED || uint8(oldState) == state {
+			return
+		}
+
+		if atomic.CompareAndSwapInt32(&p.state, oldState, int32(state)) {
+			break
+		}
+	}
+
+	if p.stateCb != nil {
+		p.stateCb(p, state, err)
+	}
+}
+
+func (p *Pipeline) handleTransportLost() {
+	p.setState(PIPELINE_STATE_DISCONNECTED, ErrPipelineTransportLost)
+	p.getNet().Close()
+	p.stopAllRequest(ErrPipelineTransportLost)
+}
+
+// dial until success or stopped.
+// @return bool, true if a new net is set.
+func (p *Pipeline) reconnect() bool {
+	p.lckNet.RLock()
+	factory, delay, maxDelay := p.netFactory, p.minDelay, p.maxDelay
+	p.lckNet.RUnlock()
+
+	if factory == nil {
+		return false
+	}
+
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for {
+		p.setState(PIPELINE_STATE_RECONNECTING, nil)
+
+		// jitter in [delay/2, delay]
+		wait := delay
+		if delay > 1 {
+			wait = delay/2 + time.Duration(rnd.Int63n(int64(delay/2)+1))
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-p.chanStop:
+			return false
+		}
+
+		net, err := factory()
+		if err == nil {
+			return p.setNet(net)
+		}
+
+		p.ec.Catch("reconnect", &err)
+		delay *= 2
+		if delay > maxDelay {
+			delay = maxDelay
+		}
+	}
+}
+
+func (p *Pipeline) setNet(net Net) bool {
+	net.SetMark(p.mark, p.peerType, p.peerNo)
+
+	// the header version is agreed again on the new net
+	p.lckWire.Lock()
+	p.lckNet.Lock()
+	if p.IsStopped() {
+		p.lckNet.Unlock()
+		p.lckWire.Unlock()
+		net.Close()
+		return false
+	}
+
+	p.net = net
+	atomic.StoreInt32(&p.wireVer, int32(RPC_HEADER_VER_1))
+	p.lckNet.Unlock()
+	p.lckWire.Unlock()
+
+	go p.recover(net)
+	return true
+}
+
+// fetch the func list on the new net, it is closed to reconnect again if failed.
+func (p *Pipeline) recover(net Net) {
+	if atomic.LoadInt32(&p.fetched) == 1 {
+		ctx, cancel := context.WithTimeout(context.Background(), RPC_RECONNECT_FETCH_TIMEOUT)
+		defer cancel()
+
+		err := p.FetchFuncListContext(ctx)
+		if err != nil {
+			p.ec.Catch("recover", &err)
+			net.Close()
+			return
+		}
+	}
+
+	// lost again while fetching
+	if p.getNet() != net {
+		return
+	}
+
+	p.setState(PIPELINE_STATE_CONNECTED, nil)
+}
@@ -0,0 +1,90 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReconnect(t *testing.T) {
+	newNet := func() Net {
+		srv, a, _ := newTestServer(t, RPC_HEADER_VER_1, &testEchoService{no: 1, delay: 100 * time.Millisecond})
+		go srv.Start()
+		t.Cleanup(srv.Stop)
+		return a
+	}
+
+	firstNet := newNet()
+	p := NewPipeline(firstNet, TEST_SERVER_PEER_TYPE, TEST_SERVER_PEER_NO, TEST_MARK)
+	p.SetInterceptor(&JsonInterceptor{})
+
+	states := make([]uint8, 0)
+	lckStates := &sync.Mutex{}
+	p.SetStateCallback(func(p *Pipeline, state uint8, err error) {
+		lckStates.Lock()
+		defer lckStates.Unlock()
+
+		states = append(states, state)
+	})
+
+	dialFails := 2
+	p.SetReconnect(func() (Net, error) {
+		if dialFails > 0 {
+			dialFails--
+			return nil, errors.New("dial failed")
+		}
+
+		return newNet(), nil
+	}, 0, 0)
+
+	go p.Start()
+	err := p.FetchFuncList()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chanErr := make(chan error, 1)
+	go func() {
+		_, err := p.Call("Echo", "Say", &testReq{}, &testResp{})
+		chanErr <- err
+	}()
+
+	// the in-flight call fail at once when the transport is lost
+	time.Sleep(20 * time.Millisecond)
+	firstNet.Close()
+	select {
+	case err = <-chanErr:
+		if !errors.Is(err, ErrPipelineTransportLost) || GetErrorCode(err) != RES_CODE_UNAVAILABLE {
+			t.Fatalf("in-flight call: %v", err)
+		}
+
+	case <-time.After(time.Second):
+		t.Fatal("in-flight call not failed")
+	}
+
+	// redial with the min delay, and fetch the func list again
+	if !waitTestCond(2*time.Second, p.IsConnected) {
+		t.Fatalf("not reconnected, state %d", p.GetState())
+	}
+
+	resp := &testResp{}
+	_, err = p.Call("Echo", "Say", &testReq{Msg: "a"}, resp)
+	if err != nil || resp.Msg != "1:a" {
+		t.Fatalf("resp %q %v, want %q", resp.Msg, err, "1:a")
+	}
+
+	p.Stop()
+
+	lckStates.Lock()
+	defer lckStates.Unlock()
+
+	if len(states) < 4 || states[0] != PIPELINE_STATE_DISCONNECTED || states[1] != PIPELINE_STATE_RECONNECTING ||
+		states[len(states)-2] != PIPELINE_STATE_CONNECTED || states[len(states)-1] != PIPELINE_STATE_STOPPED {
+		t.Fatalf("states %v", states)
+	}
+}
@@ -0,0 +1,383 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/yxlib/yx"
+)
+
+var (
+	ErrRegistryFuncExist     = errors.New("func already registered")
+	ErrRegistryFuncNoExist   = errors.New("func No. already registered")
+	ErrRegistryFuncNoReserve = errors.New("func No. is reserved")
+	ErrRegistryFuncNoUsedUp  = errors.New("func No. used up")
+	ErrRegistryHandlerNil    = errors.New("handler is nil")
+	ErrRegistryInterNil      = errors.New("interceptor is nil")
+	ErrRegistryCodecNotExist = errors.New("codec not exist")
+)
+
+const RPC_MAX_FUNC_NO = uint16(0xFFFF)
+
+type Registry struct {
+	mapFuncName2No    map[string]uint16
+	mapFuncNo2Name    map[uint16]string
+	mapFuncNo2Handler map[uint16]HandleFunc
+	mapFuncNo2ReqType map[uint16]reflect.Type
+	maxFuncNo         uint16
+	inter             Interceptor
+	mapName2Codec     map[string]Codec
+	lck               *sync.RWMutex
+
+	ec *yx.ErrCatcher
+}
+
+func NewRegistry() *Registry {
+	r := &Registry{
+		mapFuncName2No:    make(map[string]uint16),
+		mapFuncNo2Name:    make(map[uint16]string),
+		mapFuncNo2Handler: make(map[uint16]HandleFunc),
+		mapFuncNo2ReqType: make(map[uint16]reflect.Type),
+		maxFuncNo:         RPC_FUNC_NO_FUNC_LIST,
+		inter:             nil,
+		mapName2Codec:     make(map[string]Codec),
+		lck:               &sync.RWMutex{},
+
+		ec: yx.NewErrCatcher("rpc.Registry"),
+	}
+
+	r.mapFuncNo2Handler[RPC_FUNC_NO_FUNC_LIST] = r.handleFetchFuncList
+	r.mapFuncNo2Handler[RPC_FUNC_NO_HEARTBEAT] = r.handleHeartbeat
+	return r
+}
+
+func (r *Registry) SetInterceptor(inter Interceptor) {
+	r.lck.Lock()
+	defer r.lck.Unlock()
+
+	r.inter = inter
+}
+
+func (r *Registry) GetInterceptor() Interceptor {
+	r.lck.RLock()
+	defer r.lck.RUnlock()
+
+	return r.inter
+}
+
+// Add the codecs the peers can choose, by negotiation or by the codec name of each call.
+func (r *Registry) AddCodec(codecs ...Codec) {
+	r.lck.Lock()
+	defer r.lck.Unlock()
+
+	for _, codec := range codecs {
+		r.mapName2Codec[codec.GetName()] = codec
+	}
+}
+
+func (r *Registry) GetCodec(name string) (Codec, bool) {
+	r.lck.RLock()
+	defer r.lck.RUnlock()
+
+	codec, ok := r.mapName2Codec[name]
+	return codec, ok
+}
+
+// Set ServerRequest.Inter by the codec name in the header, or the default interceptor.
+// The name of a default interceptor which is a Codec is accepted too.
+// A func routed to another interceptor by the default RouteInterceptor ignore the codec name.
+// @param req, the request.
+// @return error, ErrRegistryCodecNotExist if the codec is not added.
+func (r *Registry) SelectInterceptor(req *ServerRequest) error {
+	name, ok := req.Header.GetExt(RPC_EXT_CODEC)
+	if !ok || r.isFuncRouted(req.Header.FuncNo) {
+		req.Inter = r.GetInterceptor()
+		return nil
+	}
+
+	codec, ok := r.GetCodec(string(name))
+	if ok {
+		req.Inter = codec
+		return nil
+	}
+
+	// the default one chosen by negotiateCodec
+	inter := r.GetInterceptor()
+	codec, ok = inter.(Codec)
+	if !ok || codec.GetName() != string(name) {
+		return r.ec.Throw("SelectInterceptor", ErrRegistryCodecNotExist)
+	}
+
+	req.Inter = inter
+	return nil
+}
+
+// check if the default RouteInterceptor route the func to another interceptor than its default one.
+func (r *Registry) isFuncRouted(funcNo uint16) bool {
+	route, ok := r.GetInterceptor().(*RouteInterceptor)
+	if !ok {
+		return false
+	}
+
+	fullFuncName, ok := r.GetFuncName(funcNo)
+	if !ok {
+		return false
+	}
+
+	return route.GetInterceptor(fullFuncName) != route.GetDefaultInterceptor()
+}
+
+// choose the first offered codec, or the default one.
+func (r *Registry) negotiateCodec(offer string) (Interceptor, string) {
+	for _, name := range strings.Split(offer, ",") {
+		codec, ok := r.GetCodec(name)
+		if ok {
+			return codec, name
+		}
+	}
+
+	inter := r.GetInterceptor()
+	codec, ok := inter.(Codec)
+	if ok {
+		return inter, codec.GetName()
+	}
+
+	return inter, ""
+}
+
+// Register a func, the func No. is assigned in register order.
+// @param serviceName, the service name.
+// @param funcName, the func name.
+// @param handler, the handler of the func.
+// @return uint16, the func No.
+// @return error, error.
+func (r *Registry) Register(serviceName string, funcName string, handler HandleFunc) (uint16, error) {
+	funcNo, err := r.register(serviceName, funcName, handler, nil)
+	return funcNo, r.ec.Throw("Register", err)
+}
+
+func (r *Registry) register(serviceName string, funcName string, handler HandleFunc, reqType reflect.Type) (uint16, error) {
+	if handler == nil {
+		return 0, ErrRegistryHandlerNil
+	}
+
+	r.lck.Lock()
+	defer r.lck.Unlock()
+
+	fullFuncName := GetFullFuncName(serviceName, funcName)
+	_, ok := r.mapFuncName2No[fullFuncName]
+	if ok {
+		return 0, ErrRegistryFuncExist
+	}
+
+	funcNo, err := r.allocFuncNo()
+	if err != nil {
+		return 0, err
+	}
+
+	r.mapFuncName2No[fullFuncName] = funcNo
+	r.mapFuncNo2Name[funcNo] = fullFuncName
+	r.mapFuncNo2Handler[funcNo] = handler
+	if reqType != nil {
+		r.mapFuncNo2ReqType[funcNo] = reqType
+	}
+
+	return funcNo, nil
+}
+
+// Register a stream func, it must be called by Pipeline.CallStream.
+// @param serviceName, the service name.
+// @param funcName, the func name.
+// @param handler, the stream handler of the func.
+// @return uint16, the func No.
+// @return error, error.
+func (r *Registry) RegisterStream(serviceName string, funcName string, handler StreamHandleFunc) (uint16, error) {
+	if handler == nil {
+		return 0, r.ec.Throw("RegisterStream", ErrRegistryHandlerNil)
+	}
+
+	funcNo, err := r.register(serviceName, funcName, wrapStreamHandler(handler), nil)
+	return funcNo, r.ec.Throw("RegisterStream", err)
+}
+
+// Add a handler with a fixed func No., the func will not appear in the func list.
+// @param funcNo, the func No.
+// @param handler, the handler of the func.
+// @return error, error.
+func (r *Registry) AddHandler(funcNo uint16, handler HandleFunc) error {
+	if handler == nil {
+		return r.ec.Throw("AddHandler", ErrRegistryHandlerNil)
+	}
+
+	if IsReservedFuncNo(funcNo) {
+		return r.ec.Throw("AddHandler", ErrRegistryFuncNoReserve)
+	}
+
+	r.lck.Lock()
+	defer r.lck.Unlock()
+
+	_, ok := r.mapFuncNo2Handler[funcNo]
+	if ok {
+		return r.ec.Throw("AddHandler", ErrRegistryFuncNoExist)
+	}
+
+	_, ok = r.mapFuncNo2Name[funcNo]
+	if ok {
+		return r.ec.Throw("AddHandler", ErrRegistryFuncNoExist)
+	}
+
+	r.mapFuncNo2Handler[funcNo] = handler
+	return nil
+}
+
+func (r *Registry) RemoveHandler(funcNo uint16) {
+	if IsReservedFuncNo(funcNo) {
+		return
+	}
+
+	r.lck.Lock()
+	defer r.lck.Unlock()
+
+	delete(r.mapFuncNo2Handler, funcNo)
+	delete(r.mapFuncNo2ReqType, funcNo)
+	fullFuncName, ok := r.mapFuncNo2Name[funcNo]
+	if ok {
+		delete(r.mapFuncNo2Name, funcNo)
+		delete(r.mapFuncName2No, fullFuncName)
+	}
+}
+
+func (r *Registry) GetHandler(funcNo uint16) (HandleFunc, bool) {
+	r.lck.RLock()
+	defer r.lck.RUnlock()
+
+	handler, ok := r.mapFuncNo2Handler[funcNo]
+	return handler, ok
+}
+
+func (r *Registry) GetFuncNo(serviceName string, funcName string) (uint16, bool) {
+	r.lck.RLock()
+	defer r.lck.RUnlock()
+
+	funcNo, ok := r.mapFuncName2No[GetFullFuncName(serviceName, funcName)]
+	return funcNo, ok
+}
+
+func (r *Registry) GetFuncName(funcNo uint16) (string, bool) {
+	r.lck.RLock()
+	defer r.lck.RUnlock()
+
+	fullFuncName, ok := r.mapFuncNo2Name[funcNo]
+	return fullFuncName, ok
+}
+
+// Decode the request payload to ServerRequest.ReqObj,
+// only for the funcs registered by RegisterService.
+// @param req, the request.
+// @return error, error.
+func (r *Registry) DecodeRequest(req *ServerRequest) error {
+	r.lck.RLock()
+	reqType, ok := r.mapFuncNo2ReqType[req.Header.FuncNo]
+	r.lck.RUnlock()
+
+	if !ok {
+		return nil
+	}
+
+	inter := r.getRequestInterceptor(req)
+	if inter == nil {
+		return r.ec.Throw("DecodeRequest", ErrRegistryInterNil)
+	}
+
+	reqObj := reflect.New(reqType.Elem()).Interface()
+	if len(req.Payload) > 0 {
+		err := inter.OnUnmarshal(req.FuncName, req.Payload, reqObj)
+		if err != nil {
+			return r.ec.Throw("DecodeRequest", err)
+		}
+	}
+
+	req.ReqObj = reqObj
+	return nil
+}
+
+func (r *Registry) GetFuncMapper() map[string]uint16 {
+	r.lck.RLock()
+	defer r.lck.RUnlock()
+
+	mapper := make(map[string]uint16, len(r.mapFuncName2No))
+	for name, funcNo := range r.mapFuncName2No {
+		mapper[name] = funcNo
+	}
+
+	return mapper
+}
+
+func (r *Registry) allocFuncNo() (uint16, error) {
+	funcNo := r.maxFuncNo
+	for funcNo < RPC_MAX_FUNC_NO {
+		funcNo++
+		if IsReservedFuncNo(funcNo) {
+			continue
+		}
+
+		_, ok := r.mapFuncNo2Handler[funcNo]
+		if ok {
+			continue
+		}
+
+		// push func
+		_, ok = r.mapFuncNo2Name[funcNo]
+		if ok {
+			continue
+		}
+
+		r.maxFuncNo = funcNo
+		return funcNo, nil
+	}
+
+	return 0, ErrRegistryFuncNoUsedUp
+}
+
+func (r *Registry) getRequestInterceptor(req *ServerRequest) Interceptor {
+	if req.Inter != nil {
+		return req.Inter
+	}
+
+	return r.GetInterceptor()
+}
+
+func (r *Registry) handleFetchFuncList(ctx context.Context, req *ServerRequest) (int32, []byte, error) {
+	offer, ok := req.Header.GetExt(RPC_EXT_CODEC_LIST)
+	if ok {
+		req.Inter, req.respCodec = r.negotiateCodec(string(offer))
+	}
+
+	inter := r.getRequestInterceptor(req)
+	if inter == nil {
+		return RES_CODE_SYS_ERR, nil, r.ec.Throw("handleFetchFuncList", ErrRegistryInterNil)
+	}
+
+	resp := &FetchFuncListResp{
+		MapFuncName2No: r.GetFuncMapper(),
+	}
+
+	fullFuncName := GetFullFuncName("", RPC_FUNC_NAME_FUNC_LIST)
+	payload, err := inter.OnMarshal(fullFuncName, resp)
+	if err != nil {
+		return RES_CODE_SYS_ERR, nil, r.ec.Throw("handleFetchFuncList", err)
+	}
+
+	return RES_CODE_SUCC, payload, nil
+}
+
+func (r *Registry) handleHeartbeat(ctx context.Context, req *ServerRequest) (int32, []byte, error) {
+	return RES_CODE_SUCC, nil, nil
+}
@@ -0,0 +1,170 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// the error of a request never written to the net, it is safe to retry.
+type notSentError struct {
+	err error
+}
+
+func (e *notSentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *notSentError) Unwrap() error {
+	return e.err
+}
+
+func wrapNotSent(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &notSentError{err: err}
+}
+
+// Check if the call failed before the request was written to the net.
+func IsNotSent(err error) bool {
+	var notSentErr *notSentError
+	return errors.As(err, &notSentErr)
+}
+
+//========================
+//      RetryPolicy
+//========================
+// RetryPolicy retry the failed calls with the retryable codes or errors.
+// A call already written to the net is retried only if its func is idempotent.
+type RetryPolicy struct {
+	// the max attempts including the first one
+	MaxAttempts uint32
+	// the delay before the first retry
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// the delay is multiplied after each retry
+	Multiplier float64
+	// the delay is reduced randomly by at most this fraction, in [0, 1]
+	Jitter          float64
+	RetryableCodes  []int32
+	RetryableErrors []error
+
+	mapFuncName2Idempotent map[string]bool
+	rnd                    *rand.Rand
+	lck                    *sync.Mutex
+}
+
+// Create a policy retry RES_CODE_TIMEOUT, RES_CODE_UNAVAILABLE and ErrPipelineTransportLost,
+// with backoff 100ms * 2^n up to 2s and 20% jitter.
+// @param maxAttempts, the max attempts including the first one.
+// @return *RetryPolicy, the policy.
+func NewRetryPolicy(maxAttempts uint32) *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts:     maxAttempts,
+		InitialBackoff:  100 * time.Millisecond,
+		MaxBackoff:      2 * time.Second,
+		Multiplier:      2,
+		Jitter:          0.2,
+		RetryableCodes:  []int32{RES_CODE_TIMEOUT, RES_CODE_UNAVAILABLE},
+		RetryableErrors: []error{ErrPipelineTransportLost},
+
+		mapFuncName2Idempotent: make(map[string]bool),
+		rnd:                    rand.New(rand.NewSource(time.Now().UnixNano())),
+		lck:                    &sync.Mutex{},
+	}
+}
+
+// Mark a func idempotent, so it can be retried after the request was written.
+func (rp *RetryPolicy) SetIdempotent(serviceName string, funcName string, bIdempotent bool) {
+	rp.lck.Lock()
+	defer rp.lck.Unlock()
+
+	rp.mapFuncName2Idempotent[GetFullFuncName(serviceName, funcName)] = bIdempotent
+}
+
+func (rp *RetryPolicy) IsIdempotent(serviceName string, funcName string) bool {
+	rp.lck.Lock()
+	defer rp.lck.Unlock()
+
+	return rp.mapFuncName2Idempotent[GetFullFuncName(serviceName, funcName)]
+}
+
+// Check if a failed attempt can be retried.
+// @param serviceName, the service name.
+// @param funcName, the func name.
+// @param code, the code of the attempt.
+// @param err, the error of the attempt.
+// @return bool, true if retryable.
+func (rp *RetryPolicy) IsRetryable(serviceName string, funcName string, code int32, err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if !IsNotSent(err) && !rp.IsIdempotent(serviceName, funcName) {
+		return false
+	}
+
+	for _, retryableCode := range rp.RetryableCodes {
+		if code == retryableCode {
+			return true
+		}
+	}
+
+	for _, retryableErr := range rp.RetryableErrors {
+		if errors.Is(err, retryableErr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// get the delay before the retry, attempt start at 1.
+func (rp *RetryPolicy) getBackoff(attempt uint32) time.Duration {
+	backoff := float64(rp.InitialBackoff)
+	for i := uint32(1); i < attempt; i++ {
+		backoff *= rp.Multiplier
+		if backoff > float64(rp.MaxBackoff) {
+			backoff = float64(rp.MaxBackoff)
+			break
+		}
+	}
+
+	if rp.Jitter > 0 {
+		rp.lck.Lock()
+		backoff *= 1 - rp.Jitter*rp.rnd.Float64()
+		rp.lck.Unlock()
+	}
+
+	return time.Duration(backoff)
+}
+
+// run the attempts until success, not retryable, or used up.
+// @param attemptFunc, run an attempt, attempt start at 1.
+func (rp *RetryPolicy) run(ctx context.Context, serviceName string, funcName string, attemptFunc func(attempt uint32) (int32, error)) (int32, error) {
+	attempt := uint32(1)
+	for {
+		code, err := attemptFunc(attempt)
+		if attempt >= rp.MaxAttempts || ctx.Err() != nil || !rp.IsRetryable(serviceName, funcName, code, err) {
+			return code, err
+		}
+
+		timer := time.NewTimer(rp.getBackoff(attempt))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return code, err
+		}
+
+		attempt++
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const TEST_RETRY_PEER_TYPE = uint32(11)
+
+// testDownNet fail the first writes with an error wrapping ErrNetNotConnected, as any Net may do.
+type testDownNet struct {
+	*LoopbackNet
+	fails int32
+}
+
+func (n *testDownNet) WriteRpcPack(dstPeerType uint32, dstPeerNo uint32, payload ...[]byte) error {
+	if atomic.AddInt32(&n.fails, -1) >= 0 {
+		return fmt.Errorf("%w: test net down", ErrNetNotConnected)
+	}
+
+	return n.LoopbackNet.WriteRpcPack(dstPeerType, dstPeerNo, payload...)
+}
+
+func TestRetryIdempotent(t *testing.T) {
+	down := &testEchoService{no: 1, bFail: 1}
+	up := &testEchoService{no: 2}
+	addTestClientPipeline(t, TEST_RETRY_PEER_TYPE, 1, down)
+	addTestClientPipeline(t, TEST_RETRY_PEER_TYPE, 2, up)
+
+	policy := NewRetryPolicy(3)
+	policy.InitialBackoff = time.Millisecond
+	Client.SetRetryPolicy(policy)
+	t.Cleanup(func() {
+		Client.SetRetryPolicy(nil)
+	})
+
+	// a sent call of a non-idempotent func is not retried, half of them go to the down peer
+	fails := 0
+	for i := 0; i < 4; i++ {
+		_, err := Client.CallType(TEST_RETRY_PEER_TYPE, "Echo", "Say", &testReq{}, &testResp{})
+		if err != nil {
+			fails++
+		}
+	}
+
+	if fails != 2 || down.getCalls() != 2 {
+		t.Fatalf("non-idempotent fails %d, down peer calls %d, want 2 and 2", fails, down.getCalls())
+	}
+
+	// an idempotent one is retried on the other peer
+	policy.SetIdempotent("Echo", "Say", true)
+	for i := 0; i < 4; i++ {
+		resp := &testResp{}
+		_, err := Client.CallType(TEST_RETRY_PEER_TYPE, "Echo", "Say", &testReq{Msg: "a"}, resp)
+		if err != nil || resp.Msg != "2:a" {
+			t.Fatalf("idempotent resp %q %v, want %q", resp.Msg, err, "2:a")
+		}
+	}
+
+	// or on the same peer up to the max attempts
+	downCalls := down.getCalls()
+	_, err := Client.Call(TEST_RETRY_PEER_TYPE, 1, "Echo", "Say", &testReq{}, &testResp{})
+	if GetErrorCode(err) != RES_CODE_UNAVAILABLE {
+		t.Fatalf("fixed peer: %v", err)
+	}
+
+	if down.getCalls()-downCalls != int32(policy.MaxAttempts) {
+		t.Fatalf("fixed peer attempts %d, want %d", down.getCalls()-downCalls, policy.MaxAttempts)
+	}
+}
+
+func TestRetryNotSent(t *testing.T) {
+	err := wrapNotSent(ErrPipelineNetNil)
+	if !IsNotSent(err) || IsNotSent(ErrPipelineNetNil) {
+		t.Fatalf("not sent error %v", err)
+	}
+
+	if GetErrorCode(wrapNotSent(ErrClientNoPipeline)) != RES_CODE_UNAVAILABLE {
+		t.Fatalf("not sent code %d, want %d", GetErrorCode(wrapNotSent(ErrClientNoPipeline)), RES_CODE_UNAVAILABLE)
+	}
+}
+
+func TestRetryNetNotConnected(t *testing.T) {
+	svc := &testEchoService{no: 1}
+	srv, a, _ := newTestServer(t, RPC_HEADER_VER_1, svc)
+	net := &testDownNet{LoopbackNet: a}
+	p := newTestPipeline(t, RPC_HEADER_VER_1, srv, net)
+
+	// not sent, even for a non-idempotent func
+	atomic.StoreInt32(&net.fails, 1)
+	_, err := p.Call("Echo", "Say", &testReq{}, &testResp{})
+	if !IsNotSent(err) || GetErrorCode(err) != RES_CODE_UNAVAILABLE {
+		t.Fatalf("err %v, want not sent", err)
+	}
+
+	// so it is retried
+	policy := NewRetryPolicy(3)
+	policy.InitialBackoff = time.Millisecond
+	p.SetRetryPolicy(policy)
+	atomic.StoreInt32(&net.fails, 2)
+	resp := &testResp{}
+	_, err = p.Call("Echo", "Say", &testReq{Msg: "a"}, resp)
+	if err != nil || resp.Msg != "1:a" || svc.getCalls() != 1 {
+		t.Fatalf("resp %q %v, calls %d", resp.Msg, err, svc.getCalls())
+	}
+}
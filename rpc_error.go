@@ -0,0 +1,164 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+var mapCode2Name = map[int32]string{
+	RES_CODE_SUCC:               "SUCC",
+	RES_CODE_SYS_ERR:            "SYS_ERR",
+	RES_CODE_NOT_FOUND:          "NOT_FOUND",
+	RES_CODE_TIMEOUT:            "TIMEOUT",
+	RES_CODE_CANCELLED:          "CANCELLED",
+	RES_CODE_UNAVAILABLE:        "UNAVAILABLE",
+	RES_CODE_INVALID_ARGUMENT:   "INVALID_ARGUMENT",
+	RES_CODE_PERMISSION_DENIED:  "PERMISSION_DENIED",
+	RES_CODE_RESOURCE_EXHAUSTED: "RESOURCE_EXHAUSTED",
+}
+
+func GetCodeName(code int32) string {
+	name, ok := mapCode2Name[code]
+	if !ok {
+		return fmt.Sprintf("CODE_%d", code)
+	}
+
+	return name
+}
+
+//========================
+//       RpcError
+//========================
+// RpcError is the error answered by the peer, or converted from a local error.
+// With header v2 it is json encoded in the payload and flagged by RPC_FLAG_ERR_PAYLOAD,
+// with header v1 the payload is only the message.
+type RpcError struct {
+	Code    int32             `json:"code"`
+	Message string            `json:"msg"`
+	Details map[string]string `json:"details,omitempty"`
+}
+
+func NewRpcError(code int32, msg string) *RpcError {
+	return &RpcError{
+		Code:    code,
+		Message: msg,
+		Details: nil,
+	}
+}
+
+func Errorf(code int32, format string, a ...interface{}) *RpcError {
+	return NewRpcError(code, fmt.Sprintf(format, a...))
+}
+
+func (e *RpcError) Error() string {
+	return fmt.Sprintf("rpc error: code = %s, msg = %s", GetCodeName(e.Code), e.Message)
+}
+
+// Two RpcErrors are matched by errors.Is if they have the same code.
+func (e *RpcError) Is(target error) bool {
+	t, ok := target.(*RpcError)
+	if !ok {
+		return false
+	}
+
+	return e.Code == t.Code
+}
+
+func (e *RpcError) WithDetail(key string, value string) *RpcError {
+	if e.Details == nil {
+		e.Details = make(map[string]string)
+	}
+
+	e.Details[key] = value
+	return e
+}
+
+func (e *RpcError) GetDetail(key string) (string, bool) {
+	value, ok := e.Details[key]
+	return value, ok
+}
+
+func (e *RpcError) Marshal() ([]byte, error) {
+	return json.Marshal(e)
+}
+
+// Decode the error from a response.
+// @param h, the response header, nil means header v1.
+// @param payload, the response payload.
+// @return *RpcError, the error.
+func DecodeRpcError(h *PackHeader, payload []byte) *RpcError {
+	if h == nil || !h.HasFlag(RPC_FLAG_ERR_PAYLOAD) {
+		code := RES_CODE_SYS_ERR
+		if h != nil {
+			code = h.Code
+		}
+
+		return NewRpcError(code, string(payload))
+	}
+
+	e := &RpcError{}
+	err := json.Unmarshal(payload, e)
+	if err != nil {
+		return NewRpcError(h.Code, string(payload))
+	}
+
+	e.Code = h.Code
+	return e
+}
+
+// Convert an error to a RpcError.
+func ToRpcError(err error) *RpcError {
+	if err == nil {
+		return nil
+	}
+
+	var rpcErr *RpcError
+	if errors.As(err, &rpcErr) {
+		return rpcErr
+	}
+
+	return NewRpcError(GetErrorCode(err), err.Error())
+}
+
+// Get the response code of an error.
+func GetErrorCode(err error) int32 {
+	if err == nil {
+		return RES_CODE_SUCC
+	}
+
+	var rpcErr *RpcError
+	if errors.As(err, &rpcErr) {
+		return rpcErr.Code
+	}
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, ErrPipelineCallTimeout):
+		return RES_CODE_TIMEOUT
+
+	case errors.Is(err, context.Canceled), errors.Is(err, ErrPipelineForceCallStop),
+		errors.Is(err, ErrStreamClosed):
+		return RES_CODE_CANCELLED
+
+	case errors.Is(err, ErrPipelineNotSupportFunc), errors.Is(err, ErrServerFuncNotExist):
+		return RES_CODE_NOT_FOUND
+
+	case errors.Is(err, ErrPipelineNetNil), errors.Is(err, ErrNetReadChanClose),
+		errors.Is(err, ErrNetNotConnected),
+		errors.Is(err, ErrClientNoPipeline), errors.Is(err, ErrPipelineTransportLost),
+		errors.Is(err, ErrCircuitOpen):
+		return RES_CODE_UNAVAILABLE
+
+	case errors.Is(err, ErrPipelineTooManyReqs), errors.Is(err, ErrServerRateLimited),
+		errors.Is(err, ErrStreamWindowExceeded):
+		return RES_CODE_RESOURCE_EXHAUSTED
+
+	default:
+		return RES_CODE_SYS_ERR
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// testErrService is registered as "Err", Fail answer an error with details.
+type testErrService struct {
+}
+
+func (s *testErrService) Fail(ctx context.Context, req *testReq) (*testResp, error) {
+	return nil, Errorf(RES_CODE_INVALID_ARGUMENT, "bad msg %s", req.Msg).WithDetail("field", "msg")
+}
+
+func (s *testErrService) Plain(ctx context.Context, req *testReq) (*testResp, error) {
+	return nil, errors.New("plain")
+}
+
+func newTestErrPipeline(t *testing.T, ver uint8) *Pipeline {
+	srv, a, _ := newTestServer(t, ver, nil)
+	err := srv.RegisterService("Err", &testErrService{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return newTestPipeline(t, ver, srv, a)
+}
+
+func TestRpcErrorRoundTrip(t *testing.T) {
+	p := newTestErrPipeline(t, RPC_HEADER_VER_2)
+
+	code, err := p.Call("Err", "Fail", &testReq{Msg: "a"}, &testResp{})
+	if code != RES_CODE_INVALID_ARGUMENT {
+		t.Fatalf("code %d, want %d", code, RES_CODE_INVALID_ARGUMENT)
+	}
+
+	var rpcErr *RpcError
+	if !errors.As(err, &rpcErr) {
+		t.Fatalf("%v is not a RpcError", err)
+	}
+
+	if rpcErr.Code != RES_CODE_INVALID_ARGUMENT || rpcErr.Message != "bad msg a" {
+		t.Fatalf("error %+v", rpcErr)
+	}
+
+	field, ok := rpcErr.GetDetail("field")
+	if !ok || field != "msg" {
+		t.Fatalf("detail %q %v, want %q", field, ok, "msg")
+	}
+
+	if !errors.Is(err, NewRpcError(RES_CODE_INVALID_ARGUMENT, "")) || errors.Is(err, NewRpcError(RES_CODE_SYS_ERR, "")) {
+		t.Fatal("errors.Is not matched by the code")
+	}
+
+	if GetErrorCode(err) != RES_CODE_INVALID_ARGUMENT {
+		t.Fatalf("GetErrorCode %d", GetErrorCode(err))
+	}
+
+	// a plain error is answered as a system error
+	code, err = p.Call("Err", "Plain", &testReq{}, &testResp{})
+	if code != RES_CODE_SYS_ERR || !errors.As(err, &rpcErr) || rpcErr.Message != "plain" {
+		t.Fatal(code, err)
+	}
+}
+
+func TestRpcErrorV1(t *testing.T) {
+	p := newTestErrPipeline(t, RPC_HEADER_VER_1)
+
+	// header v1 carry the code and the message only
+	code, err := p.Call("Err", "Fail", &testReq{Msg: "a"}, &testResp{})
+	var rpcErr *RpcError
+	if code != RES_CODE_INVALID_ARGUMENT || !errors.As(err, &rpcErr) {
+		t.Fatal(code, err)
+	}
+
+	if rpcErr.Code != RES_CODE_INVALID_ARGUMENT || rpcErr.Message != "bad msg a" || rpcErr.Details != nil {
+		t.Fatalf("error %+v", rpcErr)
+	}
+}
@@ -0,0 +1,537 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/yxlib/yx"
+)
+
+var (
+	ErrServerNetNil       = errors.New("rpc net is nil")
+	ErrServerFuncNotExist = errors.New("func not exist")
+)
+
+//========================
+//     ServerRequest
+//========================
+type ServerRequest struct {
+	PeerType uint32
+	PeerNo   uint32
+	Header   *PackHeader
+	Payload  []byte
+	FuncName string
+	ReqObj   interface{}
+	Inter    Interceptor
+	Metadata Metadata
+	Trailer  Metadata
+
+	respCodec       string
+	handler         HandleFunc
+	registry        *Registry
+	bMetadataLoaded bool
+	bDecoded        bool
+	decodeCode      int32
+	decodeErr       error
+}
+
+func NewServerRequest(peerType uint32, peerNo uint32, h *PackHeader, payload []byte) *ServerRequest {
+	return &ServerRequest{
+		PeerType: peerType,
+		PeerNo:   peerNo,
+		Header:   h,
+		Payload:  payload,
+		FuncName: "",
+		ReqObj:   nil,
+		Inter:    nil,
+		Metadata: Metadata{},
+		Trailer:  Metadata{},
+
+		respCodec:       "",
+		handler:         nil,
+		registry:        nil,
+		bMetadataLoaded: false,
+		bDecoded:        false,
+		decodeCode:      RES_CODE_SUCC,
+		decodeErr:       nil,
+	}
+}
+
+// Parse the metadata from the header once, the middlewares can call it before the handler.
+// @return Metadata, the metadata.
+// @return error, error if the metadata is broken.
+func (r *ServerRequest) LoadMetadata() (Metadata, error) {
+	if r.bMetadataLoaded {
+		return r.Metadata, nil
+	}
+
+	md, err := getHeaderMetadata(r.Header)
+	if err != nil {
+		return nil, err
+	}
+
+	r.Metadata = md
+	r.bMetadataLoaded = true
+	return md, nil
+}
+
+// Decode the request once, decompress the payload, load the metadata,
+// select the interceptor and decode ReqObj. The handler always get a decoded request,
+// the middlewares call it only if they need the request object.
+// @return int32, the response code if failed.
+// @return error, error.
+func (r *ServerRequest) Decode() (int32, error) {
+	if r.bDecoded {
+		return r.decodeCode, r.decodeErr
+	}
+
+	r.bDecoded = true
+	r.decodeCode, r.decodeErr = r.decode()
+	return r.decodeCode, r.decodeErr
+}
+
+func (r *ServerRequest) decode() (int32, error) {
+	payload, err := decompressHeaderPayload(r.Header, r.Payload)
+	if err != nil {
+		return RES_CODE_INVALID_ARGUMENT, err
+	}
+
+	r.Payload = payload
+	_, err = r.LoadMetadata()
+	if err != nil {
+		return RES_CODE_INVALID_ARGUMENT, err
+	}
+
+	if r.registry == nil {
+		return RES_CODE_SUCC, nil
+	}
+
+	err = r.registry.SelectInterceptor(r)
+	if err != nil {
+		return RES_CODE_INVALID_ARGUMENT, err
+	}
+
+	err = r.registry.DecodeRequest(r)
+	if err != nil {
+		return RES_CODE_INVALID_ARGUMENT, err
+	}
+
+	return RES_CODE_SUCC, nil
+}
+
+// Handle a request.
+// @param ctx, the context, canceled when the server stop.
+// @param req, the request.
+// @return int32, the response code.
+// @return []byte, the response payload.
+// @return error, error. if not nil, it is answered as a RpcError,
+//         a *RpcError decide the code itself, others use the returned code.
+type HandleFunc func(ctx context.Context, req *ServerRequest) (int32, []byte, error)
+
+//========================
+//        Server
+//========================
+type streamKey struct {
+	peerId   uint32
+	serialNo uint32
+}
+
+type Server struct {
+	net         Net
+	mark        string
+	headerVer   uint8
+	registry    *Registry
+	middlewares []ServerMiddleware
+	handler     HandleFunc
+	threshold   uint32
+
+	mapKey2Stream map[streamKey]*ServerStream
+	lckStreams    *sync.Mutex
+
+	mapPeerId2Peer map[uint32]*Peer
+	lckPeers       *sync.Mutex
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	ec     *yx.ErrCatcher
+	logger *yx.Logger
+}
+
+func NewServer(net Net, mark string) *Server {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Server{
+		net:         net,
+		mark:        mark,
+		headerVer:   RPC_HEADER_VER_2,
+		registry:    NewRegistry(),
+		middlewares: make([]ServerMiddleware, 0),
+		handler:     nil,
+		threshold:   RPC_DEFAULT_COMPRESS_THRESHOLD,
+
+		mapKey2Stream: make(map[streamKey]*ServerStream),
+		lckStreams:    &sync.Mutex{},
+
+		mapPeerId2Peer: make(map[uint32]*Peer),
+		lckPeers:       &sync.Mutex{},
+
+		ctx:    ctx,
+		cancel: cancel,
+
+		ec:     yx.NewErrCatcher("rpc.Server"),
+		logger: yx.NewLogger("rpc.Server"),
+	}
+
+	s.handler = s.decodeAndHandle
+	notifier, ok := net.(PeerConnectNotifier)
+	if ok {
+		notifier.SetPeerConnectCallback(s.resetPeer)
+	}
+
+	return s
+}
+
+func (s *Server) GetMark() string {
+	return s.mark
+}
+
+// Set the max header version agreed with the peers by FetchFuncList, RPC_HEADER_VER_2 by default,
+// see RES_CODE_HEADER_VER. The packs of a peer are v1 until a version is agreed.
+func (s *Server) SetHeaderVersion(version uint8) {
+	s.headerVer = version
+}
+
+func (s *Server) GetHeaderVersion() uint8 {
+	return s.headerVer
+}
+
+// Add middlewares to wrap the handlers, the first added one is the outermost.
+// The request is decoded inside the middlewares, so they can reject it before decoding,
+// a middleware need the request object call ServerRequest.Decode.
+func (s *Server) Use(middlewares ...ServerMiddleware) {
+	s.middlewares = append(s.middlewares, middlewares...)
+	s.handler = ChainServerMiddlewares(s.decodeAndHandle, s.middlewares...)
+}
+
+// Set the min response payload length to compress,
+// only for the requests with a compress type.
+func (s *Server) SetCompressThreshold(threshold uint32) {
+	s.threshold = threshold
+}
+
+func (s *Server) SetRegistry(registry *Registry) {
+	s.registry = registry
+}
+
+func (s *Server) GetRegistry() *Registry {
+	return s.registry
+}
+
+func (s *Server) SetInterceptor(inter Interceptor) {
+	s.registry.SetInterceptor(inter)
+}
+
+func (s *Server) AddCodec(codecs ...Codec) {
+	s.registry.AddCodec(codecs...)
+}
+
+func (s *Server) Register(serviceName string, funcName string, handler HandleFunc) (uint16, error) {
+	funcNo, err := s.registry.Register(serviceName, funcName, handler)
+	return funcNo, s.ec.Throw("Register", err)
+}
+
+func (s *Server) RegisterStream(serviceName string, funcName string, handler StreamHandleFunc) (uint16, error) {
+	funcNo, err := s.registry.RegisterStream(serviceName, funcName, handler)
+	return funcNo, s.ec.Throw("RegisterStream", err)
+}
+
+func (s *Server) RegisterService(serviceName string, service interface{}) error {
+	err := s.registry.RegisterService(serviceName, service)
+	return s.ec.Throw("RegisterService", err)
+}
+
+func (s *Server) AddHandler(funcNo uint16, handler HandleFunc) error {
+	err := s.registry.AddHandler(funcNo, handler)
+	return s.ec.Throw("AddHandler", err)
+}
+
+func (s *Server) RemoveHandler(funcNo uint16) {
+	s.registry.RemoveHandler(funcNo)
+}
+
+func (s *Server) Start() error {
+	if s.net == nil {
+		return s.ec.Throw("Start", ErrServerNetNil)
+	}
+
+	s.readPackLoop()
+	return nil
+}
+
+func (s *Server) Stop() {
+	s.cancel()
+	if s.net != nil {
+		s.net.Close()
+	}
+}
+
+func (s *Server) readPackLoop() {
+	for {
+		data, err := s.net.ReadRpcPack()
+		if err != nil {
+			break
+		}
+
+		peer := s.getOrAddPeer(data.PeerType, data.PeerNo)
+		h := NewVersionPackHeader(peer.GetHeaderVersion(), s.mark, 0, 0)
+		err = h.Unmarshal(data.Payload)
+		if err != nil {
+			s.ec.Catch("readPackLoop", &err)
+			continue
+		}
+
+		headerLen := h.GetHeaderLen()
+		payload := data.Payload[headerLen:]
+		if s.agreeHeaderVersion(peer, h, payload) {
+			continue
+		}
+
+		if s.dispatchStreamPack(data.PeerType, data.PeerNo, h, payload) {
+			continue
+		}
+
+		req := NewServerRequest(data.PeerType, data.PeerNo, h, payload)
+		stream := s.openStream(req)
+		go s.handlePack(req, stream)
+	}
+}
+
+// answer the header version offered by a v1 FetchFuncList, in the read goroutine,
+// so the next packs of the peer are read with the agreed version.
+// @return bool, true if answered, false if it is handled as a FetchFuncList.
+func (s *Server) agreeHeaderVersion(peer *Peer, h *PackHeader, payload []byte) bool {
+	if h.Version != RPC_HEADER_VER_1 || h.FuncNo != RPC_FUNC_NO_FUNC_LIST || len(payload) != RPC_HEADER_VER_OFFER_LEN {
+		return false
+	}
+
+	version := payload[0]
+	if version > s.headerVer {
+		version = s.headerVer
+	}
+
+	if version <= RPC_HEADER_VER_1 || !IsHeaderVersionSupported(version) {
+		peer.setHeaderVersion(RPC_HEADER_VER_1)
+		return false
+	}
+
+	resp := NewPackHeader(s.mark, h.SerialNo, h.FuncNo)
+	resp.Code = RES_CODE_HEADER_VER
+	headerData, err := resp.Marshal()
+	if err != nil {
+		s.ec.Catch("agreeHeaderVersion", &err)
+		return true
+	}
+
+	// no other pack is written to the peer between the answer and the switch
+	peer.lck.Lock()
+	defer peer.lck.Unlock()
+
+	err = s.net.WriteRpcPack(peer.PeerType, peer.PeerNo, headerData, []byte{version})
+	if err != nil {
+		s.ec.Catch("agreeHeaderVersion", &err)
+		return true
+	}
+
+	peer.headerVer = version
+	return true
+}
+
+// dispatch the pack of an opened stream.
+// @return bool, true if the pack belong to a stream.
+func (s *Server) dispatchStreamPack(peerType uint32, peerNo uint32, h *PackHeader, payload []byte) bool {
+	// the open pack has only RPC_FLAG_STREAM
+	if !h.HasFlag(RPC_FLAG_STREAM) || !(h.HasFlag(RPC_FLAG_STREAM_MSG) || h.HasFlag(RPC_FLAG_WINDOW_UPDATE) || h.HasFlag(RPC_FLAG_END_STREAM)) {
+		return false
+	}
+
+	key := streamKey{peerId: GetPeerId(peerType, peerNo), serialNo: h.GetSerialNo()}
+	s.lckStreams.Lock()
+	stream, ok := s.mapKey2Stream[key]
+	s.lckStreams.Unlock()
+
+	if ok {
+		stream.handlePack(h, payload)
+		return true
+	}
+
+	// the stream is already closed
+	return true
+}
+
+// open a stream for the stream request, nil for the others.
+func (s *Server) openStream(req *ServerRequest) *ServerStream {
+	h := req.Header
+	if h.Version == RPC_HEADER_VER_1 || !h.HasFlag(RPC_FLAG_STREAM) || h.GetSerialNo() == 0 || h.HasFlag(RPC_FLAG_ONE_WAY) {
+		return nil
+	}
+
+	stream := newServerStream(s, req)
+	key := streamKey{peerId: GetPeerId(req.PeerType, req.PeerNo), serialNo: h.GetSerialNo()}
+
+	s.lckStreams.Lock()
+	defer s.lckStreams.Unlock()
+
+	s.mapKey2Stream[key] = stream
+	return stream
+}
+
+func (s *Server) closeStream(stream *ServerStream) {
+	req := stream.req
+	key := streamKey{peerId: GetPeerId(req.PeerType, req.PeerNo), serialNo: req.Header.GetSerialNo()}
+
+	s.lckStreams.Lock()
+	delete(s.mapKey2Stream, key)
+	s.lckStreams.Unlock()
+
+	stream.cancel()
+}
+
+func (s *Server) handlePack(req *ServerRequest, stream *ServerStream) {
+	ctx := s.ctx
+	if stream != nil {
+		defer s.closeStream(stream)
+		ctx = newServerStreamContext(stream.Context(), stream)
+	}
+
+	flags := uint8(0)
+	code, payload, err := s.handleRequest(ctx, req)
+	if err != nil {
+		s.logger.W(err.Error())
+		code, payload, flags = s.encodeError(req, code, err)
+	}
+
+	// no return
+	if req.Header.GetSerialNo() == 0 || req.Header.HasFlag(RPC_FLAG_ONE_WAY) {
+		return
+	}
+
+	if stream != nil {
+		err = stream.end(code, flags, payload)
+	} else {
+		err = s.writeResponse(req, code, flags, payload)
+	}
+
+	s.ec.Catch("handlePack", &err)
+}
+
+func (s *Server) encodeError(req *ServerRequest, code int32, err error) (int32, []byte, uint8) {
+	var rpcErr *RpcError
+	if !errors.As(err, &rpcErr) {
+		if code == RES_CODE_SUCC {
+			code = GetErrorCode(err)
+		}
+
+		rpcErr = NewRpcError(code, err.Error())
+	}
+
+	if req.Header.Version == RPC_HEADER_VER_1 {
+		return rpcErr.Code, []byte(rpcErr.Message), 0
+	}
+
+	payload, marshalErr := rpcErr.Marshal()
+	if marshalErr != nil {
+		return rpcErr.Code, []byte(rpcErr.Message), 0
+	}
+
+	return rpcErr.Code, payload, RPC_FLAG_ERR_PAYLOAD
+}
+
+func (s *Server) handleRequest(ctx context.Context, req *ServerRequest) (int32, []byte, error) {
+	handler, ok := s.registry.GetHandler(req.Header.FuncNo)
+	if !ok {
+		return RES_CODE_NOT_FOUND, nil, ErrServerFuncNotExist
+	}
+
+	req.handler = handler
+	req.registry = s.registry
+	req.FuncName, _ = s.registry.GetFuncName(req.Header.FuncNo)
+	ctx = newServerRequestContext(ctx, req)
+	if req.Header.FuncNo == RPC_FUNC_NO_HEARTBEAT {
+		return s.decodeAndHandle(ctx, req)
+	}
+
+	return s.handler(ctx, req)
+}
+
+// the innermost handler of the middlewares, decode the request and call the func handler.
+func (s *Server) decodeAndHandle(ctx context.Context, req *ServerRequest) (int32, []byte, error) {
+	code, err := req.Decode()
+	if err != nil {
+		return code, nil, err
+	}
+
+	return req.handler(ctx, req)
+}
+
+func (s *Server) writeResponse(req *ServerRequest, code int32, flags uint8, payload []byte) error {
+	h := NewVersionPackHeader(req.Header.Version, s.mark, req.Header.GetSerialNo(), req.Header.FuncNo)
+	h.Code = code
+	h.SetFlag(flags)
+	if req.respCodec != "" && h.Version != RPC_HEADER_VER_1 {
+		h.SetExt(RPC_EXT_CODEC, []byte(req.respCodec))
+	}
+
+	// the trailer is sent with the last pack
+	var err error = nil
+	if !h.HasFlag(RPC_FLAG_STREAM) || h.HasFlag(RPC_FLAG_END_STREAM) {
+		err = setHeaderMetadata(h, req.Trailer)
+		if err != nil {
+			s.logger.W("drop trailer: " + err.Error())
+			h.RemoveExt(RPC_EXT_METADATA)
+		}
+	}
+
+	frames := [][]byte{payload}
+	compressType, ok := getHeaderCompressType(req.Header)
+	if ok && h.Version != RPC_HEADER_VER_1 {
+		frames, err = compressHeaderPayload(h, compressType, s.threshold, frames)
+		if err != nil {
+			s.logger.W("not compress: " + err.Error())
+			h.RemoveExt(RPC_EXT_COMPRESS)
+			h.ClearFlag(RPC_FLAG_COMPRESSED)
+			frames = [][]byte{payload}
+		}
+	}
+
+	err = s.writePeerPack(req.PeerType, req.PeerNo, h, frames)
+	return s.ec.Throw("writeResponse", err)
+}
+
+// write a pack with the header version agreed with the peer. A v1 header,
+// created before the version is agreed, is written with the agreed version.
+func (s *Server) writePeerPack(peerType uint32, peerNo uint32, h *PackHeader, frames [][]byte) error {
+	peer := s.getOrAddPeer(peerType, peerNo)
+	peer.lck.Lock()
+	defer peer.lck.Unlock()
+
+	if h.Version == RPC_HEADER_VER_1 && peer.headerVer != RPC_HEADER_VER_1 {
+		h.Version = peer.headerVer
+		h.SetSerialNo(uint32(h.SerialNo))
+		if h.SerialNo == 0 {
+			h.SetFlag(RPC_FLAG_ONE_WAY)
+		}
+	}
+
+	headerData, err := h.Marshal()
+	if err != nil {
+		return err
+	}
+
+	frames = append([][]byte{headerData}, frames...)
+	return s.net.WriteRpcPack(peerType, peerNo, frames...)
+}
@@ -0,0 +1,191 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/yxlib/yx"
+)
+
+var (
+	ErrServerPanic       = errors.New("handler panic")
+	ErrServerRateLimited = errors.New("rate limited")
+)
+
+// Wrap a handler, the middleware should call next to continue,
+// or return a code and an error to short-circuit the request.
+type ServerMiddleware func(ctx context.Context, req *ServerRequest, next HandleFunc) (int32, []byte, error)
+
+// Chain the middlewares, the first one is the outermost.
+// @param handler, the final handler.
+// @param middlewares, the middlewares.
+// @return HandleFunc, the chained handler.
+func ChainServerMiddlewares(handler HandleFunc, middlewares ...ServerMiddleware) HandleFunc {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = wrapServerMiddleware(middlewares[i], handler)
+	}
+
+	return handler
+}
+
+func wrapServerMiddleware(middleware ServerMiddleware, next HandleFunc) HandleFunc {
+	return func(ctx context.Context, req *ServerRequest) (int32, []byte, error) {
+		return middleware(ctx, req, next)
+	}
+}
+
+//========================
+//       recovery
+//========================
+// Recover the panic of the handler and answer RES_CODE_SYS_ERR.
+func NewRecoveryMiddleware(logger *yx.Logger) ServerMiddleware {
+	return func(ctx context.Context, req *ServerRequest, next HandleFunc) (code int32, payload []byte, err error) {
+		defer func() {
+			r := recover()
+			if r == nil {
+				return
+			}
+
+			if logger != nil {
+				logger.E(fmt.Sprintf("%s panic: %v\n%s", req.FuncName, r, debug.Stack()))
+			}
+
+			code = RES_CODE_SYS_ERR
+			payload = nil
+			err = fmt.Errorf("%w: %v", ErrServerPanic, r)
+		}()
+
+		return next(ctx, req)
+	}
+}
+
+//========================
+//         auth
+//========================
+// Check the request before the handler, the request is rejected if check return an error.
+// The request is not decoded yet, check can read the metadata by req.LoadMetadata.
+func NewAuthMiddleware(check func(ctx context.Context, req *ServerRequest) error) ServerMiddleware {
+	return func(ctx context.Context, req *ServerRequest, next HandleFunc) (int32, []byte, error) {
+		err := check(ctx, req)
+		if err != nil {
+			return RES_CODE_PERMISSION_DENIED, nil, err
+		}
+
+		return next(ctx, req)
+	}
+}
+
+//========================
+//      rate limit
+//========================
+type tokenBucket struct {
+	rate     float64
+	burst    float64
+	tokens   float64
+	lastTime time.Time
+	lck      *sync.Mutex
+}
+
+func newTokenBucket(rate float64, burst uint32) *tokenBucket {
+	return &tokenBucket{
+		rate:     rate,
+		burst:    float64(burst),
+		tokens:   float64(burst),
+		lastTime: time.Now(),
+		lck:      &sync.Mutex{},
+	}
+}
+
+func (b *tokenBucket) take() bool {
+	b.lck.Lock()
+	defer b.lck.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.lastTime).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+
+	b.lastTime = now
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+// Limit the requests of all the peers with a token bucket.
+// @param rate, the tokens added per second.
+// @param burst, the bucket size.
+// @return ServerMiddleware, the middleware.
+func NewRateLimitMiddleware(rate float64, burst uint32) ServerMiddleware {
+	bucket := newTokenBucket(rate, burst)
+	return func(ctx context.Context, req *ServerRequest, next HandleFunc) (int32, []byte, error) {
+		if !bucket.take() {
+			return RES_CODE_RESOURCE_EXHAUSTED, nil, ErrServerRateLimited
+		}
+
+		return next(ctx, req)
+	}
+}
+
+// Limit the requests of each peer with its own token bucket.
+// @param rate, the tokens added per second.
+// @param burst, the bucket size.
+// @return ServerMiddleware, the middleware.
+func NewPeerRateLimitMiddleware(rate float64, burst uint32) ServerMiddleware {
+	mapPeerId2Bucket := make(map[uint32]*tokenBucket)
+	lckBuckets := &sync.Mutex{}
+	getBucket := func(peerId uint32) *tokenBucket {
+		lckBuckets.Lock()
+		defer lckBuckets.Unlock()
+
+		bucket, ok := mapPeerId2Bucket[peerId]
+		if !ok {
+			bucket = newTokenBucket(rate, burst)
+			mapPeerId2Bucket[peerId] = bucket
+		}
+
+		return bucket
+	}
+
+	return func(ctx context.Context, req *ServerRequest, next HandleFunc) (int32, []byte, error) {
+		bucket := getBucket(GetPeerId(req.PeerType, req.PeerNo))
+		if !bucket.take() {
+			return RES_CODE_RESOURCE_EXHAUSTED, nil, ErrServerRateLimited
+		}
+
+		return next(ctx, req)
+	}
+}
+
+//========================
+//      access log
+//========================
+// Log every request with the peer, func, code, cost and error.
+func NewAccessLogMiddleware(logger *yx.Logger) ServerMiddleware {
+	return func(ctx context.Context, req *ServerRequest, next HandleFunc) (int32, []byte, error) {
+		startTime := time.Now()
+		code, payload, err := next(ctx, req)
+
+		errMsg := ""
+		if err != nil {
+			errMsg = err.Error()
+		}
+
+		logger.I(fmt.Sprintf("peer=%d-%d func=%s(%d) sno=%d code=%d cost=%s err=%s",
+			req.PeerType, req.PeerNo, req.FuncName, req.Header.FuncNo, req.Header.GetSerialNo(),
+			code, time.Since(startTime), errMsg))
+
+		return code, payload, err
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestServerMiddlewareShortCircuit(t *testing.T) {
+	svc := &testEchoService{no: 1}
+	srv, a, _ := newTestServer(t, RPC_HEADER_VER_2, svc)
+
+	bDecodedBefore := false
+	srv.Use(NewAuthMiddleware(func(ctx context.Context, req *ServerRequest) error {
+		// FetchFuncList
+		if IsReservedFuncNo(req.Header.FuncNo) {
+			return nil
+		}
+
+		// the middlewares run before the request is decoded
+		bDecodedBefore = req.ReqObj != nil
+		md, err := req.LoadMetadata()
+		if err != nil {
+			return err
+		}
+
+		token, _ := md.Get("token")
+		if token != "secret" {
+			return errors.New("bad token")
+		}
+
+		return nil
+	}))
+
+	var reqMsg string
+	srv.Use(func(ctx context.Context, req *ServerRequest, next HandleFunc) (int32, []byte, error) {
+		if IsReservedFuncNo(req.Header.FuncNo) {
+			return next(ctx, req)
+		}
+
+		_, err := req.Decode()
+		if err != nil {
+			return RES_CODE_INVALID_ARGUMENT, nil, err
+		}
+
+		reqMsg = req.ReqObj.(*testReq).Msg
+		return next(ctx, req)
+	})
+
+	p := newTestPipeline(t, RPC_HEADER_VER_2, srv, a)
+
+	// rejected by the auth middleware, the handler and the inner middleware are not run
+	_, err := p.Call("Echo", "Say", &testReq{Msg: "a"}, &testResp{})
+	if GetErrorCode(err) != RES_CODE_PERMISSION_DENIED {
+		t.Fatalf("code %d %v, want %d", GetErrorCode(err), err, RES_CODE_PERMISSION_DENIED)
+	}
+
+	if svc.getCalls() != 0 || reqMsg != "" {
+		t.Fatalf("handler called %d, inner middleware saw %q", svc.getCalls(), reqMsg)
+	}
+
+	ctx := NewOutgoingContext(context.Background(), NewMetadata(map[string]string{"token": "secret"}))
+	resp := &testResp{}
+	_, err = p.CallContext(ctx, "Echo", "Say", &testReq{Msg: "b"}, resp)
+	if err != nil || resp.Msg != "1:b" {
+		t.Fatalf("resp %q %v, want %q", resp.Msg, err, "1:b")
+	}
+
+	if bDecodedBefore || reqMsg != "b" || svc.getCalls() != 1 {
+		t.Fatalf("decoded before %v, inner middleware saw %q, handler called %d", bDecodedBefore, reqMsg, svc.getCalls())
+	}
+}
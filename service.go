@@ -0,0 +1,133 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"errors"
+	"reflect"
+)
+
+var (
+	ErrServiceNil       = errors.New("service is nil")
+	ErrServiceNameEmpty = errors.New("service name is empty")
+	ErrServiceNoFunc    = errors.New("service has no rpc func")
+)
+
+var (
+	typeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
+	typeOfError   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// Register all the exported methods shaped as
+// func(ctx context.Context, req *Req) (*Resp, error),
+// the full func name is serviceName.MethodName.
+// Nothing is registered if any method fail to register.
+// @param serviceName, the service name, use the type name if empty.
+// @param service, the service object.
+// @return error, error.
+func (r *Registry) RegisterService(serviceName string, service interface{}) error {
+	if service == nil {
+		return r.ec.Throw("RegisterService", ErrServiceNil)
+	}
+
+	v := reflect.ValueOf(service)
+	t := v.Type()
+	if serviceName == "" {
+		serviceName = reflect.Indirect(v).Type().Name()
+	}
+
+	if serviceName == "" {
+		return r.ec.Throw("RegisterService", ErrServiceNameEmpty)
+	}
+
+	funcNos := make([]uint16, 0)
+	for i := 0; i < t.NumMethod(); i++ {
+		method := t.Method(i)
+		if !isServiceMethod(method) {
+			continue
+		}
+
+		fullFuncName := GetFullFuncName(serviceName, method.Name)
+		reqType := method.Type.In(2)
+		handler := r.newServiceHandler(fullFuncName, v.Method(i), reqType)
+		funcNo, err := r.register(serviceName, method.Name, handler, reqType)
+		if err != nil {
+			// roll back the registered ones
+			for _, registered := range funcNos {
+				r.RemoveHandler(registered)
+			}
+
+			return r.ec.Throw("RegisterService", err)
+		}
+
+		funcNos = append(funcNos, funcNo)
+	}
+
+	if len(funcNos) == 0 {
+		return r.ec.Throw("RegisterService", ErrServiceNoFunc)
+	}
+
+	return nil
+}
+
+func (r *Registry) newServiceHandler(fullFuncName string, method reflect.Value, reqType reflect.Type) HandleFunc {
+	return func(ctx context.Context, req *ServerRequest) (int32, []byte, error) {
+		inter := r.getRequestInterceptor(req)
+		if inter == nil {
+			return RES_CODE_SYS_ERR, nil, ErrRegistryInterNil
+		}
+
+		// decoded by the server before the handler
+		reqObj := reflect.ValueOf(req.ReqObj)
+		if req.ReqObj == nil || reqObj.Type() != reqType {
+			reqObj = reflect.New(reqType.Elem())
+			if len(req.Payload) > 0 {
+				err := inter.OnUnmarshal(fullFuncName, req.Payload, reqObj.Interface())
+				if err != nil {
+					return RES_CODE_INVALID_ARGUMENT, nil, err
+				}
+			}
+		}
+
+		outs := method.Call([]reflect.Value{reflect.ValueOf(ctx), reqObj})
+		if !outs[1].IsNil() {
+			return RES_CODE_SYS_ERR, nil, outs[1].Interface().(error)
+		}
+
+		if outs[0].IsNil() {
+			return RES_CODE_SUCC, nil, nil
+		}
+
+		payload, err := inter.OnMarshal(fullFuncName, outs[0].Interface())
+		if err != nil {
+			return RES_CODE_SYS_ERR, nil, err
+		}
+
+		return RES_CODE_SUCC, payload, nil
+	}
+}
+
+func isServiceMethod(method reflect.Method) bool {
+	if method.PkgPath != "" {
+		return false
+	}
+
+	// receiver, ctx, req
+	mt := method.Type
+	if mt.NumIn() != 3 || mt.NumOut() != 2 {
+		return false
+	}
+
+	if mt.In(1) != typeOfContext {
+		return false
+	}
+
+	if mt.In(2).Kind() != reflect.Ptr || mt.Out(0).Kind() != reflect.Ptr {
+		return false
+	}
+
+	return mt.Out(1) == typeOfError
+}
@@ -0,0 +1,626 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+)
+
+var (
+	ErrStreamNeedV2             = errors.New("stream need header v2")
+	ErrStreamClosed             = errors.New("stream closed")
+	ErrStreamSendClosed         = errors.New("stream send closed")
+	ErrStreamNeedStreamCall     = errors.New("stream func need stream call")
+	ErrStreamWindowExceeded     = errors.New("stream window exceeded")
+	ErrStreamWindowUpdateBroken = errors.New("stream window update broken")
+)
+
+const (
+	// the messages can be sent before the receiver return the credits
+	RPC_STREAM_WINDOW = uint32(64)
+	// the credit length of a window update pack
+	RPC_STREAM_CREDIT_LEN = 4
+)
+
+// Handle a stream request, receive and send the messages by stream, the stream is ended when it return.
+// @param ctx, the context, canceled when the client close the stream or the server stop.
+// @param req, the request, the payload is the message of the open pack, may be empty.
+// @param stream, the stream to receive and send the messages.
+// @return int32, the final code.
+// @return error, error. if not nil, it is answered as a RpcError in the end pack.
+type StreamHandleFunc func(ctx context.Context, req *ServerRequest, stream *ServerStream) (int32, error)
+
+//========================
+//      streamQueue
+//========================
+// the received messages of a stream, ended once with an error.
+// the consumed messages are returned to the sender as credits.
+type streamQueue struct {
+	msgs       [][]byte
+	consumed   uint32
+	bEnd       bool
+	endErr     error
+	endHeader  *PackHeader
+	chanNotify chan struct{}
+	chanEnd    chan struct{}
+	lck        *sync.Mutex
+}
+
+func newStreamQueue() *streamQueue {
+	return &streamQueue{
+		msgs:       make([][]byte, 0),
+		consumed:   0,
+		bEnd:       false,
+		endErr:     nil,
+		endHeader:  nil,
+		chanNotify: make(chan struct{}, 1),
+		chanEnd:    make(chan struct{}),
+		lck:        &sync.Mutex{},
+	}
+}
+
+// @return error, ErrStreamWindowExceeded if the sender not respect the window.
+func (q *streamQueue) push(msg []byte) error {
+	q.lck.Lock()
+	defer q.lck.Unlock()
+
+	if q.bEnd {
+		return nil
+	}
+
+	if uint32(len(q.msgs)) >= RPC_STREAM_WINDOW {
+		return ErrStreamWindowExceeded
+	}
+
+	q.msgs = append(q.msgs, msg)
+	select {
+	case q.chanNotify <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// end the queue, the messages already pushed can still be popped.
+// @return bool, false if already ended.
+func (q *streamQueue) end(err error, h *PackHeader) bool {
+	q.lck.Lock()
+	defer q.lck.Unlock()
+
+	if q.bEnd {
+		return false
+	}
+
+	q.bEnd = true
+	q.endErr = err
+	q.endHeader = h
+	close(q.chanEnd)
+	return true
+}
+
+// pop a message.
+// @param done, stop waiting when done, can be nil.
+// @return []byte, the message.
+// @return uint32, the credits should be returned to the sender, 0 if not yet.
+// @return error, the end error.
+func (q *streamQueue) pop(done <-chan struct{}) ([]byte, uint32, error) {
+	for {
+		q.lck.Lock()
+		if len(q.msgs) > 0 {
+			msg := q.msgs[0]
+			q.msgs[0] = nil
+			q.msgs = q.msgs[1:]
+
+			credit := uint32(0)
+			q.consumed++
+			if !q.bEnd && q.consumed >= RPC_STREAM_WINDOW/2 {
+				credit = q.consumed
+				q.consumed = 0
+			}
+
+			q.lck.Unlock()
+			return msg, credit, nil
+		}
+
+		if q.bEnd {
+			q.lck.Unlock()
+			return nil, 0, q.endErr
+		}
+
+		q.lck.Unlock()
+
+		select {
+		case <-q.chanNotify:
+		case <-q.chanEnd:
+		case <-done:
+			return nil, 0, ErrStreamClosed
+		}
+	}
+}
+
+func (q *streamQueue) getEndHeader() *PackHeader {
+	q.lck.Lock()
+	defer q.lck.Unlock()
+
+	return q.endHeader
+}
+
+//========================
+//     streamWindow
+//========================
+// the send credits of a stream.
+type streamWindow struct {
+	credit     uint32
+	chanNotify chan struct{}
+	lck        *sync.Mutex
+}
+
+func newStreamWindow() *streamWindow {
+	return &streamWindow{
+		credit:     RPC_STREAM_WINDOW,
+		chanNotify: make(chan struct{}, 1),
+		lck:        &sync.Mutex{},
+	}
+}
+
+// take a credit, wait until the receiver return some.
+// @param done, stop waiting when done.
+// @return error, ErrStreamClosed if done.
+func (w *streamWindow) acquire(done <-chan struct{}) error {
+	for {
+		w.lck.Lock()
+		if w.credit > 0 {
+			w.credit--
+			w.lck.Unlock()
+			return nil
+		}
+
+		w.lck.Unlock()
+
+		select {
+		case <-w.chanNotify:
+		case <-done:
+			return ErrStreamClosed
+		}
+	}
+}
+
+func (w *streamWindow) add(credit uint32) {
+	w.lck.Lock()
+	defer w.lck.Unlock()
+
+	w.credit += credit
+	select {
+	case w.chanNotify <- struct{}{}:
+	default:
+	}
+}
+
+func marshalStreamCredit(credit uint32) []byte {
+	data := make([]byte, RPC_STREAM_CREDIT_LEN)
+	binary.BigEndian.PutUint32(data, credit)
+	return data
+}
+
+func unmarshalStreamCredit(payload []byte) (uint32, error) {
+	if len(payload) != RPC_STREAM_CREDIT_LEN {
+		return 0, ErrStreamWindowUpdateBroken
+	}
+
+	return binary.BigEndian.Uint32(payload), nil
+}
+
+//========================
+//     ClientStream
+//========================
+// ClientStream send and receive the messages of a stream call, all the packs share one serial No.
+// Send and Recv can be used by two goroutines, but each of them by only one.
+type ClientStream struct {
+	Header   *PackHeader
+	FuncName string
+
+	p          *Pipeline
+	ctx        context.Context
+	que        *streamQueue
+	window     *streamWindow
+	bSendClose bool
+	lckSend    *sync.Mutex
+}
+
+func newClientStream(ctx context.Context, p *Pipeline, h *PackHeader, funcName string) *ClientStream {
+	return &ClientStream{
+		Header:   h,
+		FuncName: funcName,
+
+		p:          p,
+		ctx:        ctx,
+		que:        newStreamQueue(),
+		window:     newStreamWindow(),
+		bSendClose: false,
+		lckSend:    &sync.Mutex{},
+	}
+}
+
+// Send a message, wait if the window of the server is used up.
+// @param payload, the message payload.
+// @return error, ErrStreamSendClosed after CloseSend, ErrStreamClosed if the stream is ended.
+func (s *ClientStream) Send(payload []byte) error {
+	err := s.window.acquire(s.que.chanEnd)
+	if err != nil {
+		return err
+	}
+
+	s.lckSend.Lock()
+	defer s.lckSend.Unlock()
+
+	if s.bSendClose {
+		return ErrStreamSendClosed
+	}
+
+	return s.p.writeStreamPack(s.ctx, s.Header, RPC_FLAG_STREAM_MSG, RES_CODE_SUCC, payload)
+}
+
+// Marshal the message by the interceptor of the pipeline and send it.
+func (s *ClientStream) SendMsg(reqObj interface{}) error {
+	inter := s.p.getInter()
+	if inter == nil {
+		return ErrPipelineInterNil
+	}
+
+	payload, err := inter.OnMarshal(s.FuncName, reqObj)
+	if err != nil {
+		return err
+	}
+
+	return s.Send(payload)
+}
+
+// Half-close the stream, the server receive io.EOF, the responses can still be received.
+func (s *ClientStream) CloseSend() error {
+	s.lckSend.Lock()
+	defer s.lckSend.Unlock()
+
+	if s.bSendClose {
+		return nil
+	}
+
+	s.bSendClose = true
+	return s.p.writeStreamPack(s.ctx, s.Header, RPC_FLAG_END_STREAM, RES_CODE_SUCC, nil)
+}
+
+// Receive a message.
+// @return []byte, the message payload.
+// @return error, io.EOF if the stream end with RES_CODE_SUCC, a *RpcError if end with other code,
+//         ctx.Err() if the ctx of the call is done.
+func (s *ClientStream) Recv() ([]byte, error) {
+	payload, credit, err := s.que.pop(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if credit > 0 {
+		err = s.p.writeStreamPack(s.ctx, s.Header, RPC_FLAG_WINDOW_UPDATE, RES_CODE_SUCC, marshalStreamCredit(credit))
+		s.p.ec.Catch("Recv", &err)
+	}
+
+	return payload, nil
+}
+
+// Receive a message and unmarshal it by the interceptor of the pipeline.
+func (s *ClientStream) RecvMsg(respObj interface{}) error {
+	payload, err := s.Recv()
+	if err != nil {
+		return err
+	}
+
+	inter := s.p.getInter()
+	if inter == nil {
+		return ErrPipelineInterNil
+	}
+
+	return inter.OnUnmarshal(s.FuncName, payload, respObj)
+}
+
+// Half-close the stream and receive the only response, for client-streaming.
+func (s *ClientStream) CloseAndRecv(respObj interface{}) error {
+	err := s.CloseSend()
+	if err != nil {
+		return err
+	}
+
+	err = s.RecvMsg(respObj)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.Recv()
+	if err != io.EOF {
+		return err
+	}
+
+	return nil
+}
+
+// Get the response metadata, valid after Recv return io.EOF or a *RpcError.
+func (s *ClientStream) Trailer() Metadata {
+	h := s.que.getEndHeader()
+	if h == nil {
+		return Metadata{}
+	}
+
+	md, err := getHeaderMetadata(h)
+	if err != nil {
+		return Metadata{}
+	}
+
+	return md
+}
+
+// Close the stream before it end, the server handler is canceled.
+func (s *ClientStream) Close() {
+	s.cancel(ErrStreamClosed)
+}
+
+func (s *ClientStream) cancel(err error) {
+	if !s.que.end(err, nil) {
+		return
+	}
+
+	s.p.removeStream(s.Header.GetSerialNo())
+	err = s.p.writeStreamPack(s.ctx, s.Header, RPC_FLAG_END_STREAM, RES_CODE_CANCELLED, nil)
+	s.p.ec.Catch("cancel", &err)
+}
+
+// close the stream when ctx is done.
+func (s *ClientStream) watchContext() {
+	if s.ctx.Done() == nil {
+		return
+	}
+
+	go func() {
+		select {
+		case <-s.ctx.Done():
+			s.cancel(s.ctx.Err())
+		case <-s.que.chanEnd:
+		}
+	}()
+}
+
+func (s *ClientStream) handlePack(h *PackHeader, payload []byte) {
+	payload, err := decompressHeaderPayload(h, payload)
+	if err != nil {
+		s.cancel(err)
+		return
+	}
+
+	if h.HasFlag(RPC_FLAG_WINDOW_UPDATE) {
+		credit, err := unmarshalStreamCredit(payload)
+		if err != nil {
+			s.cancel(err)
+			return
+		}
+
+		s.window.add(credit)
+		return
+	}
+
+	if !h.HasFlag(RPC_FLAG_END_STREAM) {
+		err = s.que.push(payload)
+		if err != nil {
+			s.cancel(err)
+		}
+
+		return
+	}
+
+	s.p.removeStream(h.GetSerialNo())
+	if h.Code == RES_CODE_SUCC {
+		s.que.end(io.EOF, h)
+	} else {
+		s.que.end(DecodeRpcError(h, payload), h)
+	}
+}
+
+//========================
+//     ServerStream
+//========================
+// ServerStream receive and send the messages of a stream request, all the packs share one serial No.
+// Send and Recv can be used by two goroutines, but each of them by only one.
+type ServerStream struct {
+	s      *Server
+	req    *ServerRequest
+	ctx    context.Context
+	cancel context.CancelFunc
+	que    *streamQueue
+	window *streamWindow
+	bEnd   bool
+	lck    *sync.Mutex
+}
+
+func newServerStream(s *Server, req *ServerRequest) *ServerStream {
+	ctx, cancel := context.WithCancel(s.ctx)
+	return &ServerStream{
+		s:      s,
+		req:    req,
+		ctx:    ctx,
+		cancel: cancel,
+		que:    newStreamQueue(),
+		window: newStreamWindow(),
+		bEnd:   false,
+		lck:    &sync.Mutex{},
+	}
+}
+
+func (s *ServerStream) Context() context.Context {
+	return s.ctx
+}
+
+// Send a message, wait if the window of the client is used up.
+// @param payload, the message payload.
+// @return error, ErrStreamClosed if the stream is ended or canceled.
+func (s *ServerStream) Send(payload []byte) error {
+	err := s.window.acquire(s.ctx.Done())
+	if err != nil {
+		return err
+	}
+
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	if s.bEnd || s.ctx.Err() != nil {
+		return ErrStreamClosed
+	}
+
+	return s.s.writeResponse(s.req, RES_CODE_SUCC, RPC_FLAG_STREAM|RPC_FLAG_STREAM_MSG, payload)
+}
+
+// Marshal the message by the interceptor of the request and send it.
+func (s *ServerStream) SendMsg(respObj interface{}) error {
+	inter := s.s.registry.getRequestInterceptor(s.req)
+	if inter == nil {
+		return ErrRegistryInterNil
+	}
+
+	payload, err := inter.OnMarshal(s.req.FuncName, respObj)
+	if err != nil {
+		return err
+	}
+
+	return s.Send(payload)
+}
+
+// Receive a message sent after the open pack.
+// @return []byte, the message payload.
+// @return error, io.EOF if the client half-closed, ErrStreamClosed if canceled.
+func (s *ServerStream) Recv() ([]byte, error) {
+	payload, credit, err := s.que.pop(s.ctx.Done())
+	if err != nil {
+		return nil, err
+	}
+
+	if credit > 0 {
+		err = s.s.writeResponse(s.req, RES_CODE_SUCC, RPC_FLAG_STREAM|RPC_FLAG_WINDOW_UPDATE, marshalStreamCredit(credit))
+		s.s.ec.Catch("Recv", &err)
+	}
+
+	return payload, nil
+}
+
+// Receive a message and unmarshal it by the interceptor of the request.
+func (s *ServerStream) RecvMsg(reqObj interface{}) error {
+	payload, err := s.Recv()
+	if err != nil {
+		return err
+	}
+
+	inter := s.s.registry.getRequestInterceptor(s.req)
+	if inter == nil {
+		return ErrRegistryInterNil
+	}
+
+	return inter.OnUnmarshal(s.req.FuncName, payload, reqObj)
+}
+
+// send the payload of a unary handler as a message, then the end pack.
+func (s *ServerStream) end(code int32, flags uint8, payload []byte) error {
+	if code == RES_CODE_SUCC && len(payload) > 0 {
+		err := s.Send(payload)
+		if err != nil {
+			return err
+		}
+
+		payload = nil
+	}
+
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	if s.bEnd {
+		return nil
+	}
+
+	s.bEnd = true
+	return s.s.writeResponse(s.req, code, flags|RPC_FLAG_STREAM|RPC_FLAG_END_STREAM, payload)
+}
+
+// the client send a message, return the credits, half-close or cancel the stream.
+func (s *ServerStream) handlePack(h *PackHeader, payload []byte) {
+	payload, err := decompressHeaderPayload(h, payload)
+	if err != nil {
+		s.abort(err)
+		return
+	}
+
+	if h.HasFlag(RPC_FLAG_WINDOW_UPDATE) {
+		credit, err := unmarshalStreamCredit(payload)
+		if err != nil {
+			s.abort(err)
+			return
+		}
+
+		s.window.add(credit)
+		return
+	}
+
+	if !h.HasFlag(RPC_FLAG_END_STREAM) {
+		err = s.que.push(payload)
+		if err != nil {
+			s.abort(err)
+		}
+
+		return
+	}
+
+	// half-close
+	if h.Code == RES_CODE_SUCC {
+		s.que.end(io.EOF, h)
+		return
+	}
+
+	// canceled, no need to send the end pack
+	s.lck.Lock()
+	s.bEnd = true
+	s.lck.Unlock()
+
+	s.que.end(ErrStreamClosed, h)
+	s.cancel()
+}
+
+// the client break the protocol, the handler get err from Recv and the end pack is still sent.
+func (s *ServerStream) abort(err error) {
+	s.s.logger.W("stream abort: " + err.Error())
+	s.que.end(err, nil)
+}
+
+//========================
+//       context
+//========================
+type serverStreamKey struct{}
+
+func newServerStreamContext(ctx context.Context, stream *ServerStream) context.Context {
+	return context.WithValue(ctx, serverStreamKey{}, stream)
+}
+
+func fromServerStreamContext(ctx context.Context) (*ServerStream, bool) {
+	stream, ok := ctx.Value(serverStreamKey{}).(*ServerStream)
+	return stream, ok
+}
+
+// wrap a stream handler, so it can be registered and run through the middlewares.
+func wrapStreamHandler(handler StreamHandleFunc) HandleFunc {
+	return func(ctx context.Context, req *ServerRequest) (int32, []byte, error) {
+		stream, ok := fromServerStreamContext(ctx)
+		if !ok {
+			return RES_CODE_INVALID_ARGUMENT, nil, ErrStreamNeedStreamCall
+		}
+
+		code, err := handler(ctx, req, stream)
+		return code, nil, err
+	}
+}
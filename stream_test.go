@@ -0,0 +1,243 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// register "Stream.List", it answer "<Msg>:<i>" for i in [0, n), n is the message of the request.
+func registerTestListStream(t *testing.T, srv *Server) {
+	_, err := srv.RegisterStream("Stream", "List", func(ctx context.Context, req *ServerRequest, st *ServerStream) (int32, error) {
+		r := &testReq{}
+		err := req.Inter.OnUnmarshal(req.FuncName, req.Payload, r)
+		if err != nil {
+			return RES_CODE_INVALID_ARGUMENT, err
+		}
+
+		n, err := strconv.Atoi(r.Msg)
+		if err != nil {
+			return RES_CODE_INVALID_ARGUMENT, err
+		}
+
+		for i := 0; i < n; i++ {
+			err = st.SendMsg(&testResp{Msg: fmt.Sprintf("%s:%d", r.Msg, i)})
+			if err != nil {
+				return RES_CODE_SYS_ERR, err
+			}
+		}
+
+		if n == 0 {
+			return RES_CODE_SUCC, NewRpcError(RES_CODE_NOT_FOUND, "empty")
+		}
+
+		req.Trailer.Set("count", r.Msg)
+		return RES_CODE_SUCC, nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStreamServer(t *testing.T) {
+	srv, a, _ := newTestServer(t, RPC_HEADER_VER_2, nil)
+	registerTestListStream(t, srv)
+	p := newTestPipeline(t, RPC_HEADER_VER_2, srv, a)
+
+	st, err := p.CallStream(context.Background(), "Stream", "List", &testReq{Msg: "3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		resp := &testResp{}
+		err = st.RecvMsg(resp)
+		if err != nil || resp.Msg != fmt.Sprintf("3:%d", i) {
+			t.Fatalf("resp %q %v", resp.Msg, err)
+		}
+	}
+
+	_, err = st.Recv()
+	if err != io.EOF {
+		t.Fatalf("err %v, want %v", err, io.EOF)
+	}
+
+	count, _ := st.Trailer().Get("count")
+	if count != "3" {
+		t.Fatalf("trailer count %q, want %q", count, "3")
+	}
+
+	// the serial No. is released after the end
+	if p.GetPendingCount() != 0 {
+		t.Fatalf("pending %d, want 0", p.GetPendingCount())
+	}
+}
+
+func TestStreamServerError(t *testing.T) {
+	srv, a, _ := newTestServer(t, RPC_HEADER_VER_2, nil)
+	registerTestListStream(t, srv)
+	p := newTestPipeline(t, RPC_HEADER_VER_2, srv, a)
+
+	st, err := p.CallStream(context.Background(), "Stream", "List", &testReq{Msg: "0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = st.Recv()
+	var rpcErr *RpcError
+	if !errors.As(err, &rpcErr) || rpcErr.Code != RES_CODE_NOT_FOUND || rpcErr.Message != "empty" {
+		t.Fatalf("err %v, want code %d", err, RES_CODE_NOT_FOUND)
+	}
+
+	// a stream func is not callable by Call
+	_, err = p.Call("Stream", "List", &testReq{Msg: "1"}, &testResp{})
+	if GetErrorCode(err) != RES_CODE_INVALID_ARGUMENT {
+		t.Fatalf("err %v, want code %d", err, RES_CODE_INVALID_ARGUMENT)
+	}
+}
+
+func TestStreamNeedV2(t *testing.T) {
+	srv, a, _ := newTestServer(t, RPC_HEADER_VER_1, nil)
+	registerTestListStream(t, srv)
+	p := newTestPipeline(t, RPC_HEADER_VER_1, srv, a)
+
+	_, err := p.CallStream(context.Background(), "Stream", "List", &testReq{Msg: "1"})
+	if !errors.Is(err, ErrStreamNeedV2) {
+		t.Fatalf("err %v, want %v", err, ErrStreamNeedV2)
+	}
+
+	if p.GetPendingCount() != 0 {
+		t.Fatalf("pending %d, want 0", p.GetPendingCount())
+	}
+}
+
+func TestStreamCredit(t *testing.T) {
+	const total = 3 * RPC_STREAM_WINDOW
+
+	var sent uint32
+	srv, a, _ := newTestServer(t, RPC_HEADER_VER_2, nil)
+	_, err := srv.RegisterStream("Stream", "Flood", func(ctx context.Context, req *ServerRequest, st *ServerStream) (int32, error) {
+		for i := uint32(0); i < total; i++ {
+			err := st.Send([]byte("x"))
+			if err != nil {
+				return RES_CODE_SYS_ERR, err
+			}
+
+			atomic.AddUint32(&sent, 1)
+		}
+
+		return RES_CODE_SUCC, nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := newTestPipeline(t, RPC_HEADER_VER_2, srv, a)
+	st, err := p.OpenStream(context.Background(), "Stream", "Flood")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the sender block when the window is used up
+	waitTestCond(time.Second, func() bool {
+		return atomic.LoadUint32(&sent) >= RPC_STREAM_WINDOW
+	})
+
+	time.Sleep(50 * time.Millisecond)
+	if atomic.LoadUint32(&sent) != RPC_STREAM_WINDOW {
+		t.Fatalf("sent %d before any read, want %d", atomic.LoadUint32(&sent), RPC_STREAM_WINDOW)
+	}
+
+	// the credits are returned while reading
+	n := uint32(0)
+	for {
+		_, err = st.Recv()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		n++
+	}
+
+	if n != total {
+		t.Fatalf("received %d, want %d", n, total)
+	}
+}
+
+func TestStreamHalfClose(t *testing.T) {
+	srv, a, _ := newTestServer(t, RPC_HEADER_VER_2, nil)
+	_, err := srv.RegisterStream("Stream", "Count", func(ctx context.Context, req *ServerRequest, st *ServerStream) (int32, error) {
+		n := 0
+		for {
+			msg := &testReq{}
+			err := st.RecvMsg(msg)
+			if err == io.EOF {
+				break
+			}
+
+			if err != nil {
+				return RES_CODE_SYS_ERR, err
+			}
+
+			n++
+		}
+
+		// still able to answer after the client half-closed
+		return RES_CODE_SUCC, st.SendMsg(&testResp{Msg: fmt.Sprint(n)})
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := newTestPipeline(t, RPC_HEADER_VER_2, srv, a)
+	st, err := p.OpenStream(context.Background(), "Stream", "Count")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// more than the window, the server return the credits
+	const total = 2*RPC_STREAM_WINDOW + 1
+	for i := uint32(0); i < total; i++ {
+		err = st.SendMsg(&testReq{Msg: "a"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = st.CloseSend()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = st.SendMsg(&testReq{})
+	if !errors.Is(err, ErrStreamSendClosed) {
+		t.Fatalf("send after half-close: %v", err)
+	}
+
+	resp := &testResp{}
+	err = st.RecvMsg(resp)
+	if err != nil || resp.Msg != fmt.Sprint(total) {
+		t.Fatalf("resp %q %v, want %d", resp.Msg, err, total)
+	}
+
+	_, err = st.Recv()
+	if err != io.EOF {
+		t.Fatalf("recv after end: %v", err)
+	}
+}
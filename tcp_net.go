@@ -0,0 +1,351 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrTCPNetPeerNotExist = fmt.Errorf("%w: peer not connected", ErrNetNotConnected)
+	ErrTCPNetPackTooLarge = errors.New("pack too large")
+	ErrTCPNetClosed       = fmt.Errorf("%w: tcp net closed", ErrNetNotConnected)
+)
+
+const (
+	TCP_NET_LEN_SIZE              = 4
+	TCP_NET_HELLO_SIZE            = 8
+	TCP_NET_HANDSHAKE_TIMEOUT     = 10 * time.Second
+	TCP_NET_DEFAULT_MAX_PACK_SIZE = uint32(16 * 1024 * 1024)
+)
+
+//========================
+//       tcpConn
+//========================
+type tcpConn struct {
+	conn     net.Conn
+	peerType uint32
+	peerNo   uint32
+	lckWrite *sync.Mutex
+}
+
+func newTcpConn(conn net.Conn, peerType uint32, peerNo uint32) *tcpConn {
+	return &tcpConn{
+		conn:     conn,
+		peerType: peerType,
+		peerNo:   peerNo,
+		lckWrite: &sync.Mutex{},
+	}
+}
+
+// write the length prefix and all the frames with one vectored write.
+func (c *tcpConn) writePack(packLen uint32, frames ...[]byte) error {
+	lenData := make([]byte, TCP_NET_LEN_SIZE)
+	binary.BigEndian.PutUint32(lenData, packLen)
+
+	buffs := make(net.Buffers, 0, len(frames)+1)
+	buffs = append(buffs, lenData)
+	buffs = append(buffs, frames...)
+
+	c.lckWrite.Lock()
+	defer c.lckWrite.Unlock()
+
+	_, err := buffs.WriteTo(c.conn)
+	return err
+}
+
+func (c *tcpConn) readPack(maxPackSize uint32) ([]byte, error) {
+	lenData := make([]byte, TCP_NET_LEN_SIZE)
+	_, err := io.ReadFull(c.conn, lenData)
+	if err != nil {
+		return nil, err
+	}
+
+	packLen := binary.BigEndian.Uint32(lenData)
+	if packLen > maxPackSize {
+		return nil, ErrTCPNetPackTooLarge
+	}
+
+	data := make([]byte, packLen)
+	_, err = io.ReadFull(c.conn, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+//========================
+//        TCPNet
+//========================
+type TCPNet struct {
+	*BaseNet
+	selfPeerType   uint32
+	selfPeerNo     uint32
+	listener       net.Listener
+	bDialer        bool
+	maxPackSize    uint32
+	mapPeerId2Conn map[uint32]*tcpConn
+	connectCb      func(peerType uint32, peerNo uint32)
+	lckConns       *sync.Mutex
+}
+
+func newTCPNet(selfPeerType uint32, selfPeerNo uint32, maxReadQue uint32) *TCPNet {
+	return &TCPNet{
+		BaseNet:        NewBaseNet(maxReadQue),
+		selfPeerType:   selfPeerType,
+		selfPeerNo:     selfPeerNo,
+		listener:       nil,
+		bDialer:        false,
+		maxPackSize:    TCP_NET_DEFAULT_MAX_PACK_SIZE,
+		mapPeerId2Conn: make(map[uint32]*tcpConn),
+		connectCb:      nil,
+		lckConns:       &sync.Mutex{},
+	}
+}
+
+// Dial to a TCPNet server, the net is closed when the connection lost.
+// @param addr, the server address.
+// @param selfPeerType, the peer type of this side.
+// @param selfPeerNo, the peer No. of this side.
+// @param maxReadQue, the max read queue size.
+// @return *TCPNet, the net.
+// @return error, error.
+func DialTCPNet(addr string, selfPeerType uint32, selfPeerNo uint32, maxReadQue uint32) (*TCPNet, error) {
+	n := newTCPNet(selfPeerType, selfPeerNo, maxReadQue)
+	n.bDialer = true
+
+	conn, err := net.DialTimeout("tcp", addr, TCP_NET_HANDSHAKE_TIMEOUT)
+	if err != nil {
+		return nil, n.ec.Throw("DialTCPNet", err)
+	}
+
+	err = n.serveConn(conn)
+	if err != nil {
+		return nil, n.ec.Throw("DialTCPNet", err)
+	}
+
+	return n, nil
+}
+
+// Listen as a TCPNet server, each accepted peer is identified by its handshake.
+// @param addr, the listen address.
+// @param selfPeerType, the peer type of this side.
+// @param selfPeerNo, the peer No. of this side.
+// @param maxReadQue, the max read queue size.
+// @return *TCPNet, the net.
+// @return error, error.
+func ListenTCPNet(addr string, selfPeerType uint32, selfPeerNo uint32, maxReadQue uint32) (*TCPNet, error) {
+	n := newTCPNet(selfPeerType, selfPeerNo, maxReadQue)
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, n.ec.Throw("ListenTCPNet", err)
+	}
+
+	n.listener = listener
+	go n.acceptLoop()
+	return n, nil
+}
+
+// Set the max pack size, it can be changed while the connections are served.
+func (n *TCPNet) SetMaxPackSize(maxPackSize uint32) {
+	atomic.StoreUint32(&n.maxPackSize, maxPackSize)
+}
+
+func (n *TCPNet) getMaxPackSize() uint32 {
+	return atomic.LoadUint32(&n.maxPackSize)
+}
+
+func (n *TCPNet) Addr() net.Addr {
+	if n.listener == nil {
+		return nil
+	}
+
+	return n.listener.Addr()
+}
+
+// rpc.PeerConnectNotifier
+func (n *TCPNet) SetPeerConnectCallback(cb func(peerType uint32, peerNo uint32)) {
+	n.lckConns.Lock()
+	defer n.lckConns.Unlock()
+
+	n.connectCb = cb
+}
+
+// rpc.Net
+func (n *TCPNet) WriteRpcPack(dstPeerType uint32, dstPeerNo uint32, payload ...[]byte) error {
+	c, ok := n.getConn(GetPeerId(dstPeerType, dstPeerNo))
+	if !ok {
+		return n.ec.Throw("WriteRpcPack", ErrTCPNetPeerNotExist)
+	}
+
+	packLen := 0
+	for _, frame := range payload {
+		packLen += len(frame)
+	}
+
+	if uint32(packLen) > n.getMaxPackSize() {
+		return n.ec.Throw("WriteRpcPack", ErrTCPNetPackTooLarge)
+	}
+
+	err := c.writePack(uint32(packLen), payload...)
+	return n.ec.Throw("WriteRpcPack", err)
+}
+
+func (n *TCPNet) Close() {
+	n.BaseNet.Close()
+	if n.listener != nil {
+		n.listener.Close()
+	}
+
+	conns := n.removeAllConns()
+	for _, c := range conns {
+		c.conn.Close()
+	}
+}
+
+func (n *TCPNet) acceptLoop() {
+	for {
+		conn, err := n.listener.Accept()
+		if err != nil {
+			if n.IsClosed() {
+				break
+			}
+
+			n.ec.Catch("acceptLoop", &err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+
+		go func() {
+			err := n.serveConn(conn)
+			n.ec.Catch("acceptLoop", &err)
+		}()
+	}
+}
+
+func (n *TCPNet) serveConn(conn net.Conn) error {
+	c, err := n.handshake(conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	if n.IsClosed() {
+		conn.Close()
+		return ErrTCPNetClosed
+	}
+
+	// before the packs of the new conn are written or read
+	cb := n.getConnectCallback()
+	if cb != nil {
+		cb(c.peerType, c.peerNo)
+	}
+
+	oldConn := n.addConn(c)
+	if oldConn != nil {
+		oldConn.conn.Close()
+	}
+
+	go n.readLoop(c)
+	return nil
+}
+
+// exchange the peer type and peer No. of both sides.
+func (n *TCPNet) handshake(conn net.Conn) (*tcpConn, error) {
+	conn.SetDeadline(time.Now().Add(TCP_NET_HANDSHAKE_TIMEOUT))
+	defer conn.SetDeadline(time.Time{})
+
+	hello := make([]byte, TCP_NET_HELLO_SIZE)
+	binary.BigEndian.PutUint32(hello, n.selfPeerType)
+	binary.BigEndian.PutUint32(hello[4:], n.selfPeerNo)
+	_, err := conn.Write(hello)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = io.ReadFull(conn, hello)
+	if err != nil {
+		return nil, err
+	}
+
+	peerType := binary.BigEndian.Uint32(hello)
+	peerNo := binary.BigEndian.Uint32(hello[4:])
+	return newTcpConn(conn, peerType, peerNo), nil
+}
+
+func (n *TCPNet) readLoop(c *tcpConn) {
+	for {
+		data, err := c.readPack(n.getMaxPackSize())
+		if err != nil {
+			break
+		}
+
+		n.AddReadPack(c.peerType, c.peerNo, data)
+	}
+
+	c.conn.Close()
+	n.removeConn(c)
+	if n.bDialer {
+		n.Close()
+	}
+}
+
+func (n *TCPNet) getConnectCallback() func(peerType uint32, peerNo uint32) {
+	n.lckConns.Lock()
+	defer n.lckConns.Unlock()
+
+	return n.connectCb
+}
+
+func (n *TCPNet) addConn(c *tcpConn) *tcpConn {
+	n.lckConns.Lock()
+	defer n.lckConns.Unlock()
+
+	peerId := GetPeerId(c.peerType, c.peerNo)
+	oldConn := n.mapPeerId2Conn[peerId]
+	n.mapPeerId2Conn[peerId] = c
+	return oldConn
+}
+
+func (n *TCPNet) getConn(peerId uint32) (*tcpConn, bool) {
+	n.lckConns.Lock()
+	defer n.lckConns.Unlock()
+
+	c, ok := n.mapPeerId2Conn[peerId]
+	return c, ok
+}
+
+func (n *TCPNet) removeConn(c *tcpConn) {
+	n.lckConns.Lock()
+	defer n.lckConns.Unlock()
+
+	peerId := GetPeerId(c.peerType, c.peerNo)
+	curConn, ok := n.mapPeerId2Conn[peerId]
+	if ok && curConn == c {
+		delete(n.mapPeerId2Conn, peerId)
+	}
+}
+
+func (n *TCPNet) removeAllConns() []*tcpConn {
+	n.lckConns.Lock()
+	defer n.lckConns.Unlock()
+
+	conns := make([]*tcpConn, 0, len(n.mapPeerId2Conn))
+	for _, c := range n.mapPeerId2Conn {
+		conns = append(conns, c)
+	}
+
+	n.mapPeerId2Conn = make(map[uint32]*tcpConn)
+	return conns
+}
@@ -0,0 +1,122 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+// listen on a random port and dial to it, wait until the listener accept the dialer.
+func newTestTCPNetPair(t *testing.T) (*TCPNet, *TCPNet) {
+	server, err := ListenTCPNet("127.0.0.1:0", TEST_SERVER_PEER_TYPE, TEST_SERVER_PEER_NO, TEST_MAX_READ_QUE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(server.Close)
+
+	client, err := DialTCPNet(server.Addr().String(), TEST_CLIENT_PEER_TYPE, TEST_CLIENT_PEER_NO, TEST_MAX_READ_QUE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(client.Close)
+
+	bAccepted := waitTestCond(time.Second, func() bool {
+		_, ok := server.getConn(GetPeerId(TEST_CLIENT_PEER_TYPE, TEST_CLIENT_PEER_NO))
+		return ok
+	})
+
+	if !bAccepted {
+		t.Fatal("dialer not accepted")
+	}
+
+	return server, client
+}
+
+func TestTCPNetFraming(t *testing.T) {
+	server, client := newTestTCPNetPair(t)
+
+	// the frames are written as one pack, the peer is known by the handshake
+	err := client.WriteRpcPack(TEST_SERVER_PEER_TYPE, TEST_SERVER_PEER_NO, []byte("ab"), nil, []byte("cde"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	large := bytes.Repeat([]byte("x"), 256*1024)
+	err = client.WriteRpcPack(TEST_SERVER_PEER_TYPE, TEST_SERVER_PEER_NO, []byte("head"), large)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range [][]byte{[]byte("abcde"), append([]byte("head"), large...)} {
+		pack, err := server.ReadRpcPack()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if pack.PeerType != TEST_CLIENT_PEER_TYPE || pack.PeerNo != TEST_CLIENT_PEER_NO {
+			t.Fatalf("peer %d-%d, want %d-%d", pack.PeerType, pack.PeerNo, TEST_CLIENT_PEER_TYPE, TEST_CLIENT_PEER_NO)
+		}
+
+		if !bytes.Equal(pack.Payload, want) {
+			t.Fatalf("payload of %d bytes, want %d bytes", len(pack.Payload), len(want))
+		}
+	}
+
+	// and the other way
+	err = server.WriteRpcPack(TEST_CLIENT_PEER_TYPE, TEST_CLIENT_PEER_NO, []byte("f"), []byte("g"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pack, err := client.ReadRpcPack()
+	if err != nil || string(pack.Payload) != "fg" {
+		t.Fatalf("payload %q %v, want %q", pack.Payload, err, "fg")
+	}
+
+	err = server.WriteRpcPack(TEST_CLIENT_PEER_TYPE, TEST_CLIENT_PEER_NO+1, []byte("x"))
+	if !errors.Is(err, ErrTCPNetPeerNotExist) {
+		t.Fatalf("write to a not connected peer: %v", err)
+	}
+
+	client.SetMaxPackSize(4)
+	err = client.WriteRpcPack(TEST_SERVER_PEER_TYPE, TEST_SERVER_PEER_NO, []byte("abc"), []byte("de"))
+	if !errors.Is(err, ErrTCPNetPackTooLarge) {
+		t.Fatalf("write a too large pack: %v", err)
+	}
+}
+
+func TestTCPNetConnLost(t *testing.T) {
+	server, client := newTestTCPNetPair(t)
+
+	// the dialer is closed when the connection lost
+	server.Close()
+	_, err := client.ReadRpcPack()
+	if err == nil || !client.IsClosed() {
+		t.Fatalf("read after the connection lost: %v", err)
+	}
+}
+
+func TestTCPNetCall(t *testing.T) {
+	server, client := newTestTCPNetPair(t)
+
+	srv := NewServer(server, TEST_MARK)
+	srv.SetInterceptor(&JsonInterceptor{})
+	err := srv.RegisterService("Echo", &testEchoService{no: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := newTestPipeline(t, RPC_HEADER_VER_1, srv, client)
+	resp := &testResp{}
+	_, err = p.Call("Echo", "Say", &testReq{Msg: "a"}, resp)
+	if err != nil || resp.Msg != "1:a" {
+		t.Fatalf("resp %q %v, want %q", resp.Msg, err, "1:a")
+	}
+}